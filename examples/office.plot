@@ -10,7 +10,7 @@ transition ToCOSI : ((location = Hallway & LabKey = yes) | location = ITL, choic
 
 transition ToITL : ((location = Hallway & LabKey = yes) | location = COSI, choice : "Enter ITL.", location -> ITL, "You walk into the ITL.")
 
-transition ToHallway : (location = COSI | location = ITL | location = Office, choice : "Leave room.", location -> Hallway, "You step out into the hallway.")
+transition ToHallway : (location in (COSI, ITL, Office), choice : "Leave room.", location -> Hallway, "You step out into the hallway.")
 
 transition ToOfficeDay : (location = Hallway & sun = day, choice : "Go to Jeanna's office.",  location -> Office, "Jeanna's door is open - you walk into her office.")
 
@@ -31,3 +31,10 @@ transition JeannaTalks : (location = Office & JeannaActivity = Working & MyActiv
 transition JeannaBusy : (location = Office & JeannaActivity = OnPhone, spontaneous 1, MyActivity -> Chilling, "Jeanna is busy talking on the phone.")
 
 transition AskForKey : (location = Office & JeannaActivity = Talking & MyActivity = Talking, choice : "Ask for a COSI key.", LabKey -> yes, "Jeanna gives you a key.")
+
+description : (location = COSI, "The COSI lab is full of humming servers and half-finished projects.")
+description : (location = ITL, "Rows of lab machines line the walls of the ITL.")
+description : (location = Hallway, "You are in the hallway outside the labs.")
+description : (location = Office & JeannaActivity = OnPhone, "Jeanna is on the phone.")
+
+ending OwnKey : (location = COSI & LabKey = yes, "You let yourself into the COSI lab with your very own key.  You belong here now.")
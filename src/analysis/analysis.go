@@ -0,0 +1,309 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Static analysis of stories.  Explore finds every state a story can get
+	into from its beginning, so that writers can find soft-locks and dead
+	code without having to play through every possibility by hand.
+
+	Spontaneous transitions are treated as things that might or might not
+	happen: any one with a chance of happening is an edge in the graph, each
+	taken on its own.  States don't include the turn, so timed transitions
+	are treated the same way, as are the outcomes of a transition that can
+	turn out more than one way.
+*/
+
+package analysis
+
+import (
+	"state"
+	"strings"
+)
+
+// The default limit on the number of states Explore will visit.
+const DefaultLimit = 100000
+
+// A Graph is the part of a story's state space reachable from its initial
+// State.  Nodes[0] is the initial State.
+type Graph struct {
+	Nodes []*Node
+
+	// Truncated is set if the limit was reached before everything had been
+	// explored, in which case the reports below are only approximate.
+	Truncated bool
+
+	universe *state.Universe
+	factors  []*state.Factor
+	enabled  map[*state.Transition]bool
+	index    map[string]*Node
+}
+
+// A Node is one reachable combination of factor values.
+type Node struct {
+	Values map[*state.Factor]state.Value
+	Edges  []Edge
+
+	graph *Graph
+	key   string
+}
+
+// An Edge is a transition that can take the story from one Node to another.
+// A transition with outcomes has an Edge for each of them.
+type Edge struct {
+	Transition *state.Transition
+	Outcome    *state.Outcome // nil if the transition has no outcomes
+	To         *Node
+}
+
+// Explore the states reachable from u's initial State, visiting at most
+// limit of them.  A limit of 0 means DefaultLimit.
+func Explore(u *state.Universe, limit int) *Graph {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	g := &Graph{
+		universe: u,
+		factors:  u.Factors(),
+		enabled:  map[*state.Transition]bool{},
+		index:    map[string]*Node{},
+	}
+
+	s := u.Instantiate()
+	queue := []*Node{g.add(g.snapshot(s))}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+
+		s := g.stateOf(n)
+		start := s.Now()
+		for _, t := range s.PossibleTransitions() {
+			if !CanHappen(t) {
+				continue
+			}
+			g.enabled[t] = true
+			outcomes := t.Outcomes()
+			if outcomes == nil {
+				outcomes = []*state.Outcome{nil}
+			}
+			for _, o := range outcomes {
+				if o != nil && o.Weight() <= 0 {
+					continue
+				}
+				t.ApplyOutcome(s, o)
+				values := g.snapshot(s)
+				s.Goto(start)
+
+				to := g.index[g.key(values)]
+				if to == nil {
+					if len(g.Nodes) >= limit {
+						g.Truncated = true
+						continue
+					}
+					to = g.add(values)
+					queue = append(queue, to)
+				}
+				n.Edges = append(n.Edges, Edge{t, o, to})
+			}
+		}
+	}
+	return g
+}
+
+// Whether t can ever happen when its condition holds: chosen transitions
+// can, and so can spontaneous ones with a chance above zero.
+func CanHappen(t *state.Transition) bool {
+	if sp, ok := t.Schedule().(state.Spontaneous); ok {
+		return sp.ProbabilityPerTurn > 0
+	}
+	return true
+}
+
+func (g *Graph) add(values map[*state.Factor]state.Value) *Node {
+	n := &Node{Values: values, graph: g, key: g.key(values)}
+	g.Nodes = append(g.Nodes, n)
+	g.index[n.key] = n
+	return n
+}
+
+func (g *Graph) snapshot(s *state.State) map[*state.Factor]state.Value {
+	values := map[*state.Factor]state.Value{}
+	for _, f := range g.factors {
+		values[f] = s.Get(f)
+	}
+	return values
+}
+
+func (g *Graph) key(values map[*state.Factor]state.Value) string {
+	vs := make([]string, len(g.factors))
+	for i, f := range g.factors {
+		vs[i] = string(values[f])
+	}
+	return strings.Join(vs, "\x00")
+}
+
+// A fresh State with n's values.
+func (g *Graph) stateOf(n *Node) *state.State {
+	overrides := map[string]string{}
+	for f, v := range n.Values {
+		overrides[f.Label()] = string(v)
+	}
+	s, _ := g.universe.InstantiateWith(overrides)
+	return s
+}
+
+// The Ending n's state has reached, if any.
+func (n *Node) Ending() *state.Ending {
+	return n.graph.stateOf(n).Ending()
+}
+
+func (n *Node) String() string {
+	vs := make([]string, len(n.graph.factors))
+	for i, f := range n.graph.factors {
+		vs[i] = f.Label() + "=" + string(n.Values[f])
+	}
+	return strings.Join(vs, " ")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Transitions that can't happen in any reachable state.
+func (g *Graph) UnreachableTransitions() []*state.Transition {
+	var ts []*state.Transition
+	for _, t := range g.universe.Transitions() {
+		if !g.enabled[t] {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// The values of each factor that it never has in any reachable state.  Only
+// factors with a list of values are checked, not numeric ones.
+func (g *Graph) UnreachableValues() map[*state.Factor][]state.Value {
+	seen := map[*state.Factor]map[state.Value]bool{}
+	for _, f := range g.factors {
+		seen[f] = map[state.Value]bool{}
+	}
+	for _, n := range g.Nodes {
+		for f, v := range n.Values {
+			seen[f][v] = true
+		}
+	}
+
+	unreached := map[*state.Factor][]state.Value{}
+	for _, f := range g.factors {
+		if f.Numeric() {
+			continue
+		}
+		for _, v := range f.Values() {
+			if !seen[f][v] {
+				unreached[f] = append(unreached[f], v)
+			}
+		}
+	}
+	return unreached
+}
+
+// Endings that no reachable state reaches.
+func (g *Graph) UnreachableEndings() []*state.Ending {
+	reached := map[*state.Ending]bool{}
+	for _, n := range g.Nodes {
+		reached[n.Ending()] = true
+	}
+	var es []*state.Ending
+	for _, e := range g.universe.Endings() {
+		if !reached[e] {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+// Reachable states the player can't do anything in, and that nothing will
+// ever happen in by itself either.  Endings don't count, since they're meant
+// to stop the story.
+func (g *Graph) DeadEnds() []*Node {
+	var dead []*Node
+	for _, n := range g.Nodes {
+		if n.Ending() != nil {
+			continue
+		}
+		stuck := true
+		for _, e := range n.Edges {
+			if e.Transition.IsChoice() || e.To != n {
+				stuck = false
+				break
+			}
+		}
+		if stuck {
+			dead = append(dead, n)
+		}
+	}
+	return dead
+}
+
+// Find the way to reach a state where target holds with the fewest choices
+// by the player.  The path includes the spontaneous transitions that have to
+// happen along the way.  Returns false if there's no way to get there.
+func (g *Graph) ShortestPath(target state.BoolExpr) ([]*state.Transition, bool) {
+	// Breadth first search, except that spontaneous transitions don't count
+	// as a step, so they go on the front of the queue instead of the back.
+	type step struct {
+		from *Node
+		by   *state.Transition
+	}
+	cost := map[*Node]int{g.Nodes[0]: 0}
+	how := map[*Node]step{}
+	done := map[*Node]bool{}
+	queue := []*Node{g.Nodes[0]}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if done[n] {
+			continue
+		}
+		done[n] = true
+
+		if target.Evaluate(g.stateOf(n)) {
+			var path []*state.Transition
+			for n != g.Nodes[0] {
+				path = append([]*state.Transition{how[n].by}, path...)
+				n = how[n].from
+			}
+			return path, true
+		}
+
+		for _, e := range n.Edges {
+			c := cost[n]
+			if e.Transition.IsChoice() {
+				c++
+			}
+			if old, ok := cost[e.To]; ok && old <= c {
+				continue
+			}
+			cost[e.To] = c
+			how[e.To] = step{n, e.Transition}
+			if e.Transition.IsChoice() {
+				queue = append(queue, e.To)
+			} else {
+				queue = append([]*Node{e.To}, queue...)
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,155 @@
+package analysis_test
+
+import (
+	"analysis"
+	"bytes"
+	"parser"
+	"state"
+	"strings"
+	"testing"
+)
+
+func assert(t *testing.T, name string, want interface{}, got interface{}) bool {
+	r := want == got
+	if !r {
+		t.Error(name, " expected:", want, " got:", got)
+	}
+	return r
+}
+
+const story = `
+factor loc : (Hall, Room, Closet, Vault)
+factor key : (no, yes)
+transition enter : (loc = Hall, choice : "Enter.", loc -> Room)
+transition grab : (loc = Room & key = no, choice : "Take key.", key -> yes)
+transition leave : (loc = Room, choice : "Leave.", loc -> Hall)
+transition trip : (loc = Room, spontaneous 0.5, loc -> Closet, "You trip into the closet.")
+transition vault : (loc = Vault, choice : "Leave vault.", loc -> Hall)
+transition never : (loc = Hall, spontaneous 0, loc -> Vault)
+`
+
+func explore(t *testing.T) (*state.Universe, *analysis.Graph) {
+	u, err := parser.ParseString(story, "story")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, analysis.Explore(u, 0)
+}
+
+func Test_Explore(t *testing.T) {
+	_, g := explore(t)
+	assert(t, "Reachable states", 6, len(g.Nodes))
+	assert(t, "Not truncated", false, g.Truncated)
+	assert(t, "Start", "loc=Hall key=no", g.Nodes[0].String())
+}
+
+func Test_Truncated(t *testing.T) {
+	u, _ := explore(t)
+	g := analysis.Explore(u, 2)
+	assert(t, "Limited states", 2, len(g.Nodes))
+	assert(t, "Truncated", true, g.Truncated)
+}
+
+func Test_Unreachable(t *testing.T) {
+	u, g := explore(t)
+
+	ts := g.UnreachableTransitions()
+	if assert(t, "Unreachable transitions", 2, len(ts)) {
+		assert(t, "Unreachable 1", "vault", ts[0].Label())
+		assert(t, "Unreachable 2", "never", ts[1].Label())
+	}
+
+	vs := g.UnreachableValues()
+	assert(t, "Factors with unreachable values", 1, len(vs))
+	if loc := vs[u.FindFactor("loc")]; assert(t, "Unreachable locations", 1, len(loc)) {
+		assert(t, "Unreachable location", state.Value("Vault"), loc[0])
+	}
+}
+
+func Test_DeadEnds(t *testing.T) {
+	_, g := explore(t)
+	dead := g.DeadEnds()
+	if assert(t, "Dead ends", 2, len(dead)) {
+		assert(t, "Dead end 1", "loc=Closet key=no", dead[0].String())
+		assert(t, "Dead end 2", "loc=Closet key=yes", dead[1].String())
+	}
+}
+
+func Test_ShortestPath(t *testing.T) {
+	u, g := explore(t)
+	loc, key := u.FindFactor("loc"), u.FindFactor("key")
+
+	path, ok := g.ShortestPath(state.MkAnd(state.FactorEquals{Factor: key, Value: "yes"}, state.FactorEquals{Factor: loc, Value: "Hall"}))
+	if assert(t, "Found key path", true, ok) && assert(t, "Key path length", 3, len(path)) {
+		assert(t, "Step 1", "enter", path[0].Label())
+		assert(t, "Step 2", "grab", path[1].Label())
+		assert(t, "Step 3", "leave", path[2].Label())
+	}
+
+	path, ok = g.ShortestPath(state.FactorEquals{Factor: loc, Value: "Closet"})
+	if assert(t, "Found closet path", true, ok) && assert(t, "Closet path length", 2, len(path)) {
+		assert(t, "Spontaneous step", "trip", path[1].Label())
+	}
+
+	_, ok = g.ShortestPath(state.FactorEquals{Factor: loc, Value: "Vault"})
+	assert(t, "No vault path", false, ok)
+}
+
+func Test_WriteDot(t *testing.T) {
+	_, g := explore(t)
+	var buf bytes.Buffer
+	if !assert(t, "Written", nil, g.WriteDot(&buf)) {
+		return
+	}
+	dot := buf.String()
+	assert(t, "State nodes", 6, strings.Count(dot, "[label=\"loc="))
+	assert(t, "Start node", true, strings.Contains(dot, `s0 [label="loc=Hall\nkey=no", style=bold];`))
+	assert(t, "Chosen edge", true, strings.Contains(dot, `s0 -> s1 [label="enter\nEnter."];`))
+	assert(t, "Spontaneous edge", true, strings.Contains(dot, `[label="trip", style=dashed];`))
+
+	u, err := parser.ParseString("factor loc : (Hall, Room)\n"+
+		"transition go : (loc = Hall | loc = Room, choice : \"Leave the {loc}{if loc = Room} again{/if}.\", loc -> Room)\n", "story")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	analysis.Explore(u, 0).WriteDot(&buf)
+	dot = buf.String()
+	assert(t, "Template filled in", true, strings.Contains(dot, `s0 -> s1 [label="go\nLeave the Hall."];`))
+	assert(t, "Template filled in from the state", true, strings.Contains(dot, `s1 -> s1 [label="go\nLeave the Room again."];`))
+}
+
+func Test_Endings(t *testing.T) {
+	u, err := parser.ParseString(story+`
+ending closet : (loc = Closet & key = yes, "Locked in, but with the key.")
+ending vault : (loc = Vault, "Rich.")
+`, "story")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := analysis.Explore(u, 0)
+
+	dead := g.DeadEnds()
+	if assert(t, "Dead ends", 1, len(dead)) {
+		assert(t, "Dead end", "loc=Closet key=no", dead[0].String())
+	}
+	es := g.UnreachableEndings()
+	if assert(t, "Unreachable endings", 1, len(es)) {
+		assert(t, "Unreachable ending", "vault", es[0].Label())
+	}
+}
+
+func Test_Outcomes(t *testing.T) {
+	u, err := parser.ParseString("factor door : (shut, open, stuck)\n"+
+		"transition try : (door = shut, choice : \"Try the door.\", outcomes : 0.7 -> (door -> open), 0.3 -> (door -> stuck))\n", "story")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := analysis.Explore(u, 0)
+	assert(t, "Every outcome reached", 3, len(g.Nodes))
+	if assert(t, "Edge per outcome", 2, len(g.Nodes[0].Edges)) {
+		e := g.Nodes[0].Edges[1]
+		assert(t, "Outcome", u.Transitions()[0].Outcomes()[1], e.Outcome)
+		assert(t, "Outcome leads on", "door=stuck", e.To.String())
+	}
+}
@@ -0,0 +1,74 @@
+/*
+   This file is part of Plotomaton.
+
+   Plotomaton is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   Plotomaton is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+   Author - Sean Anderson
+   Contact: fnordit@gmail.com
+*/
+
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Write the whole state graph as a Graphviz DOT graph: one node for every
+// reachable state, and an edge for every transition between them.  Chosen
+// transitions are drawn solid, spontaneous ones dashed, and endings are
+// double outlined.  Edges for outcomes are labelled with their chance.  This
+// gets big fast, so it's only useful for small stories.
+func (g *Graph) WriteDot(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	id := map[*Node]int{}
+	for i, n := range g.Nodes {
+		id[n] = i
+	}
+
+	fmt.Fprintf(b, "digraph states {\n")
+	for i, n := range g.Nodes {
+		style := ""
+		if i == 0 {
+			style = ", style=bold"
+		}
+		label := strings.Replace(n.String(), " ", "\n", -1)
+		if e := n.Ending(); e != nil {
+			label = "ending " + e.Label() + "\n" + label
+			style += ", peripheries=2"
+		}
+		fmt.Fprintf(b, "\ts%d [label=%q%s];\n", i, label, style)
+	}
+	for _, n := range g.Nodes {
+		for _, e := range n.Edges {
+			label := e.Transition.Label()
+			if e.Outcome != nil {
+				label += " [" + strconv.FormatFloat(e.Transition.Chance(e.Outcome), 'g', 3, 64) + "]"
+			}
+			if e.Transition.IsChoice() {
+				fmt.Fprintf(b, "\ts%d -> s%d [label=%q];\n", id[n], id[e.To], label+"\n"+e.Transition.Choice(g.stateOf(n)))
+			} else {
+				fmt.Fprintf(b, "\ts%d -> s%d [label=%q, style=dashed];\n", id[n], id[e.To], label)
+			}
+		}
+	}
+	if g.Truncated {
+		fmt.Fprintf(b, "\ttruncated [label=\"(more states not shown)\", shape=plaintext];\n")
+	}
+	fmt.Fprintf(b, "}\n")
+	return b.Flush()
+}
@@ -0,0 +1,295 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Syntax trees for stories, as written: names are just names, not yet
+	looked up, and the comments are kept, so that a story can be printed
+	back out again.
+*/
+
+package ast
+
+// A Pos is where something starts in a story file.  Lines and columns count
+// from 1.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+// A File is a whole story.
+type File struct {
+	Name     string
+	Decls    []Decl
+	Comments []*Comment
+}
+
+// A Comment runs from a % to the end of the line.  Text includes the %.
+type Comment struct {
+	Pos  Pos
+	Text string
+}
+
+// A Decl is one top level declaration.  End is the line its closing
+// parenthesis or value is on.
+type Decl interface {
+	Start() Pos
+	EndLine() int
+}
+
+// factor NAME : (VALUE, ...) = INITIAL, or factor NAME : (MIN:MAX) = INITIAL
+// for a numeric factor.  Initial is "" if not given.
+type FactorDecl struct {
+	Pos        Pos
+	End        int
+	Name       string
+	Values     []string
+	Numeric    bool
+	Min, Max   int
+	Initial    string
+	InitialPos Pos
+}
+
+// transition NAME : (CONDITION, SCHEDULE, EFFECTS, "description").  The name
+// and description may be left out, and are then "" and nil.  A transition
+// with outcomes : ... in place of its effects and description has Outcomes
+// instead.  Priority is the N of a priority N after the schedule, or 0.
+type TransitionDecl struct {
+	Pos         Pos
+	End         int
+	Name        string
+	Condition   Expr
+	Schedule    Schedule
+	Priority    int
+	Effects     []*Effect
+	Description *Text
+	Outcomes    []*Outcome
+}
+
+// description : (CONDITION, "text")
+type DescriptionDecl struct {
+	Pos       Pos
+	End       int
+	Condition Expr
+	Text      *Text
+}
+
+// ending NAME : (CONDITION, "text")
+type EndingDecl struct {
+	Pos       Pos
+	End       int
+	Name      string
+	Condition Expr
+	Text      *Text
+}
+
+// include "PATH", where the path is relative to the including file.  File
+// is the included story, filled in when includes are followed.  It is left
+// nil if the same file was already included somewhere else.
+type IncludeDecl struct {
+	Pos  Pos
+	End  int
+	Path string
+	File *File
+}
+
+// exclusive NAME : (TRANSITION, TRANSITION, ...).  The name may be left out.
+type ExclusiveDecl struct {
+	Pos         Pos
+	End         int
+	Name        string
+	Transitions []*Ref
+}
+
+// The name of a transition, where it's referred to.
+type Ref struct {
+	Pos  Pos
+	Name string
+}
+
+// option NAME
+type OptionDecl struct {
+	Pos  Pos
+	End  int
+	Name string
+}
+
+func (d *FactorDecl) Start() Pos      { return d.Pos }
+func (d *TransitionDecl) Start() Pos  { return d.Pos }
+func (d *DescriptionDecl) Start() Pos { return d.Pos }
+func (d *EndingDecl) Start() Pos      { return d.Pos }
+func (d *IncludeDecl) Start() Pos     { return d.Pos }
+func (d *ExclusiveDecl) Start() Pos   { return d.Pos }
+func (d *OptionDecl) Start() Pos      { return d.Pos }
+
+func (d *FactorDecl) EndLine() int      { return d.End }
+func (d *TransitionDecl) EndLine() int  { return d.End }
+func (d *DescriptionDecl) EndLine() int { return d.End }
+func (d *EndingDecl) EndLine() int      { return d.End }
+func (d *IncludeDecl) EndLine() int     { return d.End }
+func (d *ExclusiveDecl) EndLine() int   { return d.End }
+func (d *OptionDecl) EndLine() int      { return d.End }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// A Schedule is a Choice, Spontaneous, After, Every or AtTurn.
+type Schedule interface {
+	Start() Pos
+}
+
+// choice : "text"
+type Choice struct {
+	Pos  Pos
+	Text *Text
+}
+
+// spontaneous PROBABILITY
+type Spontaneous struct {
+	Pos         Pos
+	Probability float64
+}
+
+// after N
+type After struct {
+	Pos   Pos
+	Turns int
+}
+
+// every N
+type Every struct {
+	Pos   Pos
+	Turns int
+}
+
+// at turn N
+type AtTurn struct {
+	Pos  Pos
+	Turn int
+}
+
+func (s *Choice) Start() Pos      { return s.Pos }
+func (s *Spontaneous) Start() Pos { return s.Pos }
+func (s *After) Start() Pos       { return s.Pos }
+func (s *Every) Start() Pos       { return s.Pos }
+func (s *AtTurn) Start() Pos      { return s.Pos }
+
+// WEIGHT -> (EFFECTS, "text"), one of the ways a transition can turn out.
+// Description is nil if the outcome has no text of its own.
+type Outcome struct {
+	Pos         Pos
+	Weight      float64
+	Effects     []*Effect
+	Description *Text
+}
+
+// An Effect is FACTOR -> VALUE, FACTOR + N or FACTOR - N.  Op is "->", "+"
+// or "-".
+type Effect struct {
+	Pos    Pos
+	Factor string
+	Op     string
+	Value  string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Text is quoted text.  Raw is the text as written, apart from escapes, and
+// Parts is the same text split up into its template parts: {factor} and
+// {if CONDITION}...{else}...{/if}.
+type Text struct {
+	Pos   Pos
+	Raw   string
+	Parts []TextPart
+}
+
+// A TextPart is a *Literal, *Value or *If.
+type TextPart interface {
+	textPart()
+}
+
+// Text shown as it is.
+type Literal struct {
+	Text string
+}
+
+// {FACTOR}
+type Value struct {
+	Factor string
+}
+
+// {if CONDITION}THEN{else}ELSE{/if}, where the else part may be left out.
+type If struct {
+	Condition Expr
+	Then      []TextPart
+	Else      []TextPart
+}
+
+func (*Literal) textPart() {}
+func (*Value) textPart()   {}
+func (*If) textPart()      {}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// An Expr is a condition.
+type Expr interface {
+	Start() Pos
+}
+
+// CLAUSE & CLAUSE & ...
+type And struct {
+	Clauses []Expr
+}
+
+// CLAUSE | CLAUSE | ...
+type Or struct {
+	Clauses []Expr
+}
+
+// not CLAUSE
+type Not struct {
+	Pos    Pos
+	Clause Expr
+}
+
+// (CONDITION)
+type Paren struct {
+	Pos Pos
+	X   Expr
+}
+
+// FACTOR OP VALUE, where Op is one of = != < <= > >=
+type Compare struct {
+	Pos    Pos
+	Factor string
+	Op     string
+	Value  string
+}
+
+// FACTOR in (VALUE, ...), or FACTOR not in (VALUE, ...) if Not is set.
+type In struct {
+	Pos    Pos
+	Factor string
+	Not    bool
+	Values []string
+}
+
+func (e *And) Start() Pos     { return e.Clauses[0].Start() }
+func (e *Or) Start() Pos      { return e.Clauses[0].Start() }
+func (e *Not) Start() Pos     { return e.Pos }
+func (e *Paren) Start() Pos   { return e.Pos }
+func (e *Compare) Start() Pos { return e.Pos }
+func (e *In) Start() Pos      { return e.Pos }
@@ -0,0 +1,133 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	The command-line flags shared by everything that plays a story: which
+	story, the random seed, and factors to start with set to something else.
+*/
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"parser"
+	"state"
+	"strings"
+)
+
+// Factor values given with --set, to start the story somewhere other than
+// the beginning.
+type overrides map[string]string
+
+func (o overrides) String() string {
+	var sets []string
+	for f, v := range o {
+		sets = append(sets, f+"="+v)
+	}
+	return strings.Join(sets, ",")
+}
+
+func (o overrides) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return fmt.Errorf("expected factor=value, got %q", s)
+	}
+	o[s[:i]] = s[i+1:]
+	return nil
+}
+
+// The flags of commands that read a story.  Commands that run it also take
+// the random seed, and factors to start with set to something else.
+type StoryFlags struct {
+	*flag.FlagSet
+	Seed int64
+	Sets overrides
+}
+
+func NewStoryFlags(name string, running bool) *StoryFlags {
+	f := &StoryFlags{flag.NewFlagSet(name, flag.ExitOnError), 0, overrides{}}
+	if running {
+		f.Var(f.Sets, "set", "start with `factor=value` (may be repeated)")
+		f.Int64Var(&f.Seed, "seed", 0, "random `seed`, to play the same way again (default: pick one)")
+	}
+	return f
+}
+
+// Parses args, which should end with the story, and reads the story.
+// Returns nil if it can't be used, after saying why.
+func (f *StoryFlags) Story(args []string) *state.Universe {
+	f.Parse(args)
+	if f.NArg() != 1 {
+		f.Usage()
+		return nil
+	}
+	return readStory(f.Arg(0))
+}
+
+// Whether --seed was given, so that even --seed 0 is kept.
+func (f *StoryFlags) Seeded() bool {
+	given := false
+	f.Visit(func(fl *flag.Flag) {
+		if fl.Name == "seed" {
+			given = true
+		}
+	})
+	return given
+}
+
+// Picks a seed at random, unless one was given with --seed.
+func (f *StoryFlags) PickSeed() {
+	if !f.Seeded() {
+		f.Seed = rand.Int63()
+	}
+}
+
+// Starts u, with the factors given by --set.
+func (f *StoryFlags) Start(u *state.Universe) (*state.State, error) {
+	s, err := u.InstantiateWith(f.Sets)
+	if err != nil {
+		return nil, fmt.Errorf("--set: %s", err)
+	}
+	return s, nil
+}
+
+// Starts u the way plotomaton play does: with the factors given by --set,
+// random numbers from --seed, and the first turn already run.
+func (f *StoryFlags) Play(u *state.Universe) (*state.State, *state.RNG, error) {
+	s, err := f.Start(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := state.NewRNG(f.Seed)
+	s.SetRand(r.Rand)
+	s.RunSpontaneous(r.Rand)
+	return s, r, nil
+}
+
+// Reads a story, printing any errors or warnings in it.  Returns nil if it
+// has errors.
+func readStory(name string) *state.Universe {
+	u, err := parser.ParseFile(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+	return u
+}
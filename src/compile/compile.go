@@ -0,0 +1,358 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Turns a story's syntax tree into a Universe.  This is where names are
+	looked up, so undeclared factors and impossible initial values are
+	found here rather than while parsing.  It also keeps track of where
+	everything in the Universe was declared, so that problems found later
+	on can be traced back to the source.
+*/
+
+package compile
+
+import (
+	"ast"
+	"fmt"
+	"state"
+	"strconv"
+	"strings"
+)
+
+// An Error is a name that doesn't refer to anything, or a value a factor
+// can't take, in the same terms as the parser's errors.
+type Error struct {
+	Filename string
+	Pos      ast.Pos
+	Expected string
+	Found    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: expected %s, found %s", e.Filename, e.Pos.Line, e.Pos.Column, e.Expected, e.Found)
+}
+
+// An ErrorList is every Error found in one story, in source order.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// A SourceMap says which declaration each Factor, Transition, Description,
+// Ending and Exclusive of a Universe came from, and which file that was in.
+type SourceMap struct {
+	decls map[interface{}]ast.Decl
+	files map[ast.Decl]string
+}
+
+// The declaration x came from, or nil if it isn't from this story.
+func (m *SourceMap) Decl(x interface{}) ast.Decl {
+	return m.decls[x]
+}
+
+// Where x was declared, as file:line:column, or "" if it isn't from this
+// story.
+func (m *SourceMap) Position(x interface{}) string {
+	d := m.decls[x]
+	if d == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%d", m.files[d], d.Start().Line, d.Start().Column)
+}
+
+// Fills in the position of each error's subject.
+func (m *SourceMap) Locate(errs state.ValidationErrors) {
+	for _, e := range errs {
+		if e.Pos == "" {
+			e.Pos = m.Position(e.Subject)
+		}
+	}
+}
+
+var comparisons = map[string]state.Comparison{
+	"<":  state.Less,
+	"<=": state.LessEq,
+	">":  state.Greater,
+	">=": state.GreaterEq,
+}
+
+type compiler struct {
+	u          *state.Universe
+	name       string
+	decls      map[interface{}]ast.Decl
+	files      map[ast.Decl]string
+	errors     ErrorList
+	exclusives []*ast.ExclusiveDecl // left until every transition is declared
+}
+
+// The options a story can set with option NAME.
+var options = map[string]func(u *state.Universe){
+	"settle": func(u *state.Universe) { u.SetSettle(true) },
+}
+
+// Builds a Universe from f.  An included file's declarations are added where
+// it is included, so it has to have been read in already.  If any names
+// don't refer to anything, or any initial values are impossible, returns an
+// ErrorList of them all instead.
+func Compile(f *ast.File) (*state.Universe, *SourceMap, error) {
+	c := &compiler{u: state.NewUniverse(), decls: map[interface{}]ast.Decl{}, files: map[ast.Decl]string{}}
+	c.file(f)
+	// Exclusive groups can name transitions declared after them
+	for _, d := range c.exclusives {
+		c.name = c.files[d]
+		c.decls[c.exclusive(d)] = d
+	}
+	if len(c.errors) > 0 {
+		return nil, nil, c.errors
+	}
+	return c.u, &SourceMap{c.decls, c.files}, nil
+}
+
+func (c *compiler) file(f *ast.File) {
+	for _, d := range f.Decls {
+		c.name = f.Name
+		c.files[d] = f.Name
+		switch d := d.(type) {
+		case *ast.FactorDecl:
+			c.decls[c.factor(d)] = d
+		case *ast.TransitionDecl:
+			c.decls[c.transition(d)] = d
+		case *ast.DescriptionDecl:
+			desc := c.u.AddDescription(c.expr(d.Condition), d.Text.Raw)
+			desc.SetTemplate(c.text(d.Text))
+			c.decls[desc] = d
+		case *ast.EndingDecl:
+			e := c.u.AddEnding(d.Name, c.expr(d.Condition), d.Text.Raw)
+			e.SetTemplate(c.text(d.Text))
+			c.decls[e] = d
+		case *ast.IncludeDecl:
+			if d.File != nil {
+				c.file(d.File)
+			}
+		case *ast.ExclusiveDecl:
+			c.exclusives = append(c.exclusives, d)
+		case *ast.OptionDecl:
+			if set := options[d.Name]; set != nil {
+				set(c.u)
+			} else {
+				c.report(d.Pos, "known option", "name "+strconv.Quote(d.Name))
+			}
+		}
+	}
+}
+
+// Builds a condition about the factors of u.  The filename is used in
+// error messages.
+func Expr(u *state.Universe, e ast.Expr, filename string) (state.BoolExpr, error) {
+	c := &compiler{u: u, name: filename}
+	b := c.expr(e)
+	if len(c.errors) > 0 {
+		return nil, c.errors
+	}
+	return b, nil
+}
+
+func (c *compiler) report(pos ast.Pos, expected string, found string) {
+	c.errors = append(c.errors, &Error{Filename: c.name, Pos: pos, Expected: expected, Found: found})
+}
+
+func (c *compiler) factor(d *ast.FactorDecl) *state.Factor {
+	var f *state.Factor
+	if d.Numeric {
+		f = c.u.AddNumericFactor(d.Name, d.Min, d.Min, d.Max)
+	} else {
+		var initial string
+		if len(d.Values) > 0 {
+			initial = d.Values[0]
+		}
+		f = c.u.AddFactor(d.Name, initial, d.Values)
+	}
+	if d.Initial != "" {
+		if !f.Possible(state.Value(d.Initial)) {
+			c.report(d.InitialPos, "one of "+d.Name+"'s values", d.Initial)
+		}
+		f.SetInitial(state.Value(d.Initial))
+	}
+	return f
+}
+
+func (c *compiler) lookup(pos ast.Pos, name string) *state.Factor {
+	f := c.u.FindFactor(name)
+	if f == nil {
+		c.report(pos, "declared factor", "name "+strconv.Quote(name))
+	}
+	return f
+}
+
+func (c *compiler) transition(d *ast.TransitionDecl) *state.Transition {
+	condition := c.expr(d.Condition)
+	var schedule state.Schedule
+	var choice *ast.Text
+	switch s := d.Schedule.(type) {
+	case *ast.Spontaneous:
+		schedule = state.Spontaneous{ProbabilityPerTurn: s.Probability}
+	case *ast.Choice:
+		schedule = state.Chosen{Description: s.Text.Raw}
+		choice = s.Text
+	case *ast.After:
+		schedule = state.After{Turns: s.Turns}
+	case *ast.Every:
+		schedule = state.Every{Turns: s.Turns}
+	case *ast.AtTurn:
+		schedule = state.AtTurn{Turn: s.Turn}
+	}
+	effects, deltas := c.effects(d.Effects)
+	t := c.u.AddTransition(d.Name, condition, schedule, raw(d.Description), effects)
+	t.SetPriority(d.Priority)
+	t.SetTemplate(c.text(d.Description))
+	t.SetChoiceTemplate(c.text(choice))
+	for fac, n := range deltas {
+		t.AddDelta(fac, n)
+	}
+	for _, od := range d.Outcomes {
+		effects, deltas := c.effects(od.Effects)
+		o := t.AddOutcome(od.Weight, raw(od.Description), effects)
+		o.SetTemplate(c.text(od.Description))
+		for fac, n := range deltas {
+			o.AddDelta(fac, n)
+		}
+	}
+	return t
+}
+
+func (c *compiler) exclusive(d *ast.ExclusiveDecl) *state.Exclusive {
+	var ts []*state.Transition
+	for _, ref := range d.Transitions {
+		var found *state.Transition
+		for _, t := range c.u.Transitions() {
+			if t.Label() == ref.Name {
+				found = t
+				break
+			}
+		}
+		if found == nil {
+			c.report(ref.Pos, "declared transition", "name "+strconv.Quote(ref.Name))
+			continue
+		}
+		ts = append(ts, found)
+	}
+	return c.u.AddExclusive(d.Name, ts)
+}
+
+// Sorts effects into the values they set and the amounts they add.
+func (c *compiler) effects(es []*ast.Effect) (map[*state.Factor]state.Value, map[*state.Factor]int) {
+	effects := make(map[*state.Factor]state.Value)
+	deltas := make(map[*state.Factor]int)
+	for _, e := range es {
+		fac := c.lookup(e.Pos, e.Factor)
+		switch e.Op {
+		case "->":
+			effects[fac] = state.Value(e.Value)
+		case "+", "-":
+			n, _ := strconv.Atoi(e.Value)
+			if e.Op == "-" {
+				n = -n
+			}
+			deltas[fac] += n
+		}
+	}
+	return effects, deltas
+}
+
+// The text as written, or "" if there isn't any.
+func raw(t *ast.Text) string {
+	if t == nil {
+		return ""
+	}
+	return t.Raw
+}
+
+// Builds the Template for text, or nil if there's no text.
+func (c *compiler) text(t *ast.Text) state.Template {
+	if t == nil {
+		return nil
+	}
+	return c.textParts(t.Pos, t.Parts)
+}
+
+func (c *compiler) textParts(pos ast.Pos, parts []ast.TextPart) state.Template {
+	tmpl := state.Template{}
+	for _, part := range parts {
+		switch part := part.(type) {
+		case *ast.Literal:
+			tmpl = append(tmpl, state.TemplateText(part.Text))
+		case *ast.Value:
+			tmpl = append(tmpl, state.TemplateValue{Factor: c.lookup(pos, part.Factor)})
+		case *ast.If:
+			tmpl = append(tmpl, state.TemplateIf{
+				Condition: c.expr(part.Condition),
+				Then:      c.textParts(pos, part.Then),
+				Else:      c.textParts(pos, part.Else),
+			})
+		}
+	}
+	return tmpl
+}
+
+func (c *compiler) expr(e ast.Expr) state.BoolExpr {
+	switch e := e.(type) {
+	case *ast.And:
+		clauses := make([]state.BoolExpr, len(e.Clauses))
+		for i, clause := range e.Clauses {
+			clauses[i] = c.expr(clause)
+		}
+		return state.MkAnd(clauses...)
+	case *ast.Or:
+		clauses := make([]state.BoolExpr, len(e.Clauses))
+		for i, clause := range e.Clauses {
+			clauses[i] = c.expr(clause)
+		}
+		return state.MkOr(clauses...)
+	case *ast.Not:
+		return state.MkNot(c.expr(e.Clause))
+	case *ast.Paren:
+		return c.expr(e.X)
+	case *ast.Compare:
+		fac := c.lookup(e.Pos, e.Factor)
+		switch e.Op {
+		case "=":
+			return state.FactorEquals{Factor: fac, Value: state.Value(e.Value)}
+		case "!=":
+			return state.MkNot(state.FactorEquals{Factor: fac, Value: state.Value(e.Value)})
+		}
+		n, _ := strconv.Atoi(e.Value)
+		return state.Compare{Factor: fac, Op: comparisons[e.Op], Value: n}
+	case *ast.In:
+		fac := c.lookup(e.Pos, e.Factor)
+		clauses := make([]state.BoolExpr, len(e.Values))
+		for i, v := range e.Values {
+			clauses[i] = state.FactorEquals{Factor: fac, Value: state.Value(v)}
+		}
+		if e.Not {
+			return state.MkNot(state.MkOr(clauses...))
+		}
+		return state.MkOr(clauses...)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package compile_test
+
+import (
+	"compile"
+	"parser"
+	"state"
+	"strings"
+	"testing"
+)
+
+func assert(t *testing.T, name string, want interface{}, got interface{}) bool {
+	r := want == got
+	if !r {
+		t.Error(name, " expected:", want, " got:", got)
+	}
+	return r
+}
+
+func Test_Compile(t *testing.T) {
+	f, err := parser.NewParser(strings.NewReader("factor sun : (day, night)\n"+
+		"\n"+
+		"  transition set : (sun = day, spontaneous 1, sun -> night)\n"), "story").ParseAST()
+	if !assert(t, "Parsed", nil, err) {
+		return
+	}
+	u, m, err := compile.Compile(f)
+	if !assert(t, "No errors", nil, err) {
+		return
+	}
+	sun := u.FindFactor("sun")
+	assert(t, "Factor declared", "story:1:1", m.Position(sun))
+	assert(t, "Transition declared", "story:3:3", m.Position(u.Transitions()[0]))
+	assert(t, "Declaration", f.Decls[0], m.Decl(sun))
+	assert(t, "Not from the story", "", m.Position(state.NewUniverse()))
+}
+
+func Test_CompileErrors(t *testing.T) {
+	f, _ := parser.NewParser(strings.NewReader("factor sun : (day, night) = noon\n"+
+		"transition t : (moon = full, choice : \"x\", sun -> day)\n"), "story").ParseAST()
+	u, _, err := compile.Compile(f)
+	assert(t, "No universe", true, u == nil)
+	errs, ok := err.(compile.ErrorList)
+	if assert(t, "Error list", true, ok) && assert(t, "Error count", 2, len(errs)) {
+		assert(t, "Bad initial", "story:1:29: expected one of sun's values, found noon", errs[0].Error())
+		assert(t, "Undeclared", "story:2:17: expected declared factor, found name \"moon\"", errs[1].Error())
+	}
+}
+
+func Test_Locate(t *testing.T) {
+	f, _ := parser.NewParser(strings.NewReader("factor sun : (day, night)\n"+
+		"transition t : (sun = day, choice : \"x\", sun -> noon)\n"), "story").ParseAST()
+	u, m, _ := compile.Compile(f)
+	errs := u.Validate().(state.ValidationErrors)
+	m.Locate(errs)
+	if assert(t, "One problem", 1, len(errs)) {
+		assert(t, "Located", "story:2:1: transition t: effect sets sun to unknown value noon", errs[0].Error())
+	}
+}
@@ -0,0 +1,360 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Prints stories in a standard layout, for plotomaton fmt.  Declarations
+	go one to a line, with the ':'s of neighbouring declarations of the
+	same kind lined up.  Transitions too long for one line are split up,
+	one part to a line.  Comments and blank lines between declarations are
+	kept, though a comment inside a declaration is moved to just before it.
+*/
+
+package format
+
+import (
+	"ast"
+	"bufio"
+	"bytes"
+	"io"
+	"parser"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Transitions longer than this are split over several lines.
+const lineWidth = 80
+
+// What wrapped transitions' parts, and the lines of triple-quoted text, are
+// indented by.
+const indent = "    "
+
+// A block is a declaration, or a comment on a line of its own, along with
+// the source lines it covered.
+type block struct {
+	first, last int
+	comment     *ast.Comment
+
+	decl     ast.Decl
+	head     string   // "factor NAME" and so on, up to the ':'
+	body     string   // everything after the ':', on one line
+	lines    []string // printed instead of head : body, if set
+	moved    []*ast.Comment
+	trailing *ast.Comment
+}
+
+// Reads a story from src and prints it back out in the standard layout.
+// The name is used in error messages.
+func Source(src []byte, name string) ([]byte, error) {
+	f, err := parser.NewParser(bytes.NewReader(src), name).ParseAST()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := Fprint(&out, f); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Prints f to w in the standard layout.
+func Fprint(w io.Writer, f *ast.File) error {
+	blocks := splitBlocks(f)
+	align(blocks)
+
+	out := bufio.NewWriter(w)
+	for i, b := range blocks {
+		if i > 0 && b.first > blocks[i-1].last+1 {
+			out.WriteString("\n")
+		}
+		if b.comment != nil {
+			out.WriteString(commentText(b.comment) + "\n")
+			continue
+		}
+		for _, c := range b.moved {
+			out.WriteString(commentText(c) + "\n")
+		}
+		lines := b.lines
+		if lines == nil {
+			lines = []string{b.head + " : " + b.body}
+		}
+		out.WriteString(strings.Join(lines, "\n"))
+		if b.trailing != nil {
+			out.WriteString("  " + commentText(b.trailing))
+		}
+		out.WriteString("\n")
+	}
+	return out.Flush()
+}
+
+// Sorts f's comments in among its declarations.
+func splitBlocks(f *ast.File) []*block {
+	var blocks []*block
+	comments := f.Comments
+	for _, d := range f.Decls {
+		for len(comments) > 0 && comments[0].Pos.Line < d.Start().Line {
+			c := comments[0]
+			blocks = append(blocks, &block{first: c.Pos.Line, last: c.Pos.Line, comment: c})
+			comments = comments[1:]
+		}
+		b := &block{first: d.Start().Line, last: d.EndLine(), decl: d}
+		for len(comments) > 0 && comments[0].Pos.Line <= d.EndLine() {
+			// A comment on the last line comes after everything else on it
+			if comments[0].Pos.Line == d.EndLine() {
+				b.trailing = comments[0]
+			} else {
+				b.moved = append(b.moved, comments[0])
+			}
+			comments = comments[1:]
+		}
+		b.head, b.body = declaration(d)
+		if t, ok := d.(*ast.TransitionDecl); ok && (width(b.head)+3+width(b.body) > lineWidth || strings.Contains(b.body, "\n")) {
+			b.lines = wrapTransition(b.head, t)
+		}
+		if inc, ok := d.(*ast.IncludeDecl); ok {
+			b.lines = []string{"include " + quote(inc.Path)}
+		}
+		if opt, ok := d.(*ast.OptionDecl); ok {
+			b.lines = []string{"option " + opt.Name}
+		}
+		blocks = append(blocks, b)
+	}
+	for _, c := range comments {
+		blocks = append(blocks, &block{first: c.Pos.Line, last: c.Pos.Line, comment: c})
+	}
+	return blocks
+}
+
+// Lines up the ':'s of each run of one line declarations of the same kind,
+// with no blank lines or comments between them.
+func align(blocks []*block) {
+	joins := func(a, b *block) bool {
+		return a.decl != nil && b.decl != nil && a.lines == nil && b.lines == nil &&
+			len(b.moved) == 0 && b.first == a.last+1 &&
+			reflect.TypeOf(a.decl) == reflect.TypeOf(b.decl)
+	}
+	for i := 0; i < len(blocks); {
+		j := i + 1
+		for j < len(blocks) && joins(blocks[j-1], blocks[j]) {
+			j++
+		}
+		most := 0
+		for _, b := range blocks[i:j] {
+			if width(b.head) > most {
+				most = width(b.head)
+			}
+		}
+		for _, b := range blocks[i:j] {
+			if b.decl != nil && b.lines == nil {
+				b.head += strings.Repeat(" ", most-width(b.head))
+			}
+		}
+		i = j
+	}
+}
+
+// How many columns s takes up.
+func width(s string) int {
+	return utf8.RuneCountInString(s)
+}
+
+func commentText(c *ast.Comment) string {
+	return strings.TrimRight(c.Text, " \r")
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// Quotes text so that it reads back the same.  Text with line breaks in it
+// is triple-quoted, a line to a line, unless the parser would take out some
+// of its own indentation or quotes.
+func quote(s string) string {
+	lines := strings.Split(s, "\n")
+	triple := len(lines) > 1 && !strings.Contains(s, "\"\"\"") && !strings.HasSuffix(s, "\"")
+	indented := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" && strings.TrimLeft(line, " \t") == line {
+			indented = false
+		}
+	}
+	if !triple || indented {
+		return "\"" + escaper.Replace(s) + "\""
+	}
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + strings.Replace(line, "\\", "\\\\", -1)
+		}
+	}
+	return "\"\"\"\n" + strings.Join(lines, "\n") + "\n" + indent + "\"\"\""
+}
+
+// Splits a declaration into the part before its ':' and the part after.
+func declaration(d ast.Decl) (string, string) {
+	switch d := d.(type) {
+	case *ast.FactorDecl:
+		var body string
+		if d.Numeric {
+			body = "(" + strconv.Itoa(d.Min) + ":" + strconv.Itoa(d.Max) + ")"
+		} else {
+			body = "(" + strings.Join(d.Values, ", ") + ")"
+		}
+		if d.Initial != "" {
+			body += " = " + d.Initial
+		}
+		return named("factor", d.Name), body
+	case *ast.TransitionDecl:
+		return named("transition", d.Name), "(" + strings.Join(transitionParts(d), ", ") + ")"
+	case *ast.DescriptionDecl:
+		return "description", "(" + Expr(d.Condition) + ", " + quote(d.Text.Raw) + ")"
+	case *ast.EndingDecl:
+		return named("ending", d.Name), "(" + Expr(d.Condition) + ", " + quote(d.Text.Raw) + ")"
+	case *ast.ExclusiveDecl:
+		names := make([]string, len(d.Transitions))
+		for i, ref := range d.Transitions {
+			names[i] = ref.Name
+		}
+		return named("exclusive", d.Name), "(" + strings.Join(names, ", ") + ")"
+	}
+	return "", ""
+}
+
+func named(keyword string, name string) string {
+	if name == "" {
+		return keyword
+	}
+	return keyword + " " + name
+}
+
+// The parts of a transition between its parentheses.
+func transitionParts(t *ast.TransitionDecl) []string {
+	parts := []string{Expr(t.Condition), schedule(t.Schedule)}
+	if t.Priority != 0 {
+		parts[1] += " priority " + strconv.Itoa(t.Priority)
+	}
+	if len(t.Outcomes) > 0 {
+		return append(parts, "outcomes : "+strings.Join(outcomes(t.Outcomes), ", "))
+	}
+	parts = append(parts, effects(t.Effects))
+	if t.Description != nil {
+		parts = append(parts, quote(t.Description.Raw))
+	}
+	return parts
+}
+
+// Wrapped transitions have a line for each part, and one more for each
+// outcome, indented under "outcomes :".
+func wrapTransition(head string, t *ast.TransitionDecl) []string {
+	parts := transitionParts(t)
+	var more []string
+	if len(t.Outcomes) > 0 {
+		parts[len(parts)-1] = "outcomes :"
+		more = outcomes(t.Outcomes)
+	}
+	lines := []string{head + " : ("}
+	for i, part := range parts {
+		if i < len(parts)-1 {
+			part += ","
+		}
+		lines = append(lines, indent+part)
+	}
+	for i, o := range more {
+		if i < len(more)-1 {
+			o += ","
+		}
+		lines = append(lines, indent+indent+o)
+	}
+	return append(lines, ")")
+}
+
+func outcomes(list []*ast.Outcome) []string {
+	printed := make([]string, len(list))
+	for i, o := range list {
+		var parts []string
+		for _, e := range o.Effects {
+			parts = append(parts, effect(e))
+		}
+		if o.Description != nil {
+			parts = append(parts, quote(o.Description.Raw))
+		}
+		printed[i] = strconv.FormatFloat(o.Weight, 'f', -1, 64) + " -> (" + strings.Join(parts, ", ") + ")"
+	}
+	return printed
+}
+
+func schedule(s ast.Schedule) string {
+	switch s := s.(type) {
+	case *ast.Choice:
+		return "choice : " + quote(s.Text.Raw)
+	case *ast.Spontaneous:
+		return "spontaneous " + strconv.FormatFloat(s.Probability, 'f', -1, 64)
+	case *ast.After:
+		return "after " + strconv.Itoa(s.Turns)
+	case *ast.Every:
+		return "every " + strconv.Itoa(s.Turns)
+	case *ast.AtTurn:
+		return "at turn " + strconv.Itoa(s.Turn)
+	}
+	return ""
+}
+
+func effects(es []*ast.Effect) string {
+	printed := make([]string, len(es))
+	for i, e := range es {
+		printed[i] = effect(e)
+	}
+	if len(printed) == 1 {
+		return printed[0]
+	}
+	return "(" + strings.Join(printed, ", ") + ")"
+}
+
+func effect(e *ast.Effect) string {
+	return e.Factor + " " + e.Op + " " + e.Value
+}
+
+// Prints a condition the way it would be written in a story.
+func Expr(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.And:
+		return exprs(e.Clauses, " & ")
+	case *ast.Or:
+		return exprs(e.Clauses, " | ")
+	case *ast.Not:
+		return "not " + Expr(e.Clause)
+	case *ast.Paren:
+		return "(" + Expr(e.X) + ")"
+	case *ast.Compare:
+		return e.Factor + " " + e.Op + " " + e.Value
+	case *ast.In:
+		op := " in "
+		if e.Not {
+			op = " not in "
+		}
+		return e.Factor + op + "(" + strings.Join(e.Values, ", ") + ")"
+	}
+	return ""
+}
+
+func exprs(es []ast.Expr, sep string) string {
+	printed := make([]string, len(es))
+	for i, e := range es {
+		printed[i] = Expr(e)
+	}
+	return strings.Join(printed, sep)
+}
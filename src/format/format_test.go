@@ -0,0 +1,129 @@
+package format_test
+
+import (
+	"format"
+	"strings"
+	"testing"
+)
+
+func assert(t *testing.T, name string, want interface{}, got interface{}) bool {
+	r := want == got
+	if !r {
+		t.Error(name, " expected:", want, " got:", got)
+	}
+	return r
+}
+
+func source(t *testing.T, src string) string {
+	out, err := format.Source([]byte(src), "story")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func Test_Spacing(t *testing.T) {
+	got := source(t, "factor  sun:(day,night)initial night\n"+
+		"factor gold : ( 0 : 10 )\n\n\n\n"+
+		"transition t:(sun=day&gold>=2|not gold<1,spontaneous 0.5,gold-2)\n"+
+		"description:(sun in(day),\"Bright.\")\n")
+	assert(t, "Canonical form", "factor sun  : (day, night) = night\n"+
+		"factor gold : (0:10)\n\n"+
+		"transition t : (sun = day & gold >= 2 | not gold < 1, spontaneous 0.5, gold - 2)\n"+
+		"description : (sun in (day), \"Bright.\")\n", got)
+}
+
+func Test_Wrapping(t *testing.T) {
+	got := source(t, "transition long : (place = hall, choice : \"Walk all the way down the hall.\", place -> end, \"You walk and walk.\")\n")
+	assert(t, "Wrapped", "transition long : (\n"+
+		"    place = hall,\n"+
+		"    choice : \"Walk all the way down the hall.\",\n"+
+		"    place -> end,\n"+
+		"    \"You walk and walk.\"\n"+
+		")\n", got)
+}
+
+func Test_Comments(t *testing.T) {
+	got := source(t, "% The sun\n"+
+		"factor sun : (day, night) % trailing\n"+
+		"ending dark : (sun = night,\n"+
+		"  % inside\n"+
+		"  \"Dark.\")\n"+
+		"% the end")
+	assert(t, "Comments kept", "% The sun\n"+
+		"factor sun : (day, night)  % trailing\n"+
+		"% inside\n"+
+		"ending dark : (sun = night, \"Dark.\")\n"+
+		"% the end\n", got)
+}
+
+func Test_Include(t *testing.T) {
+	got := source(t, "include   \"common.plot\"\nfactor été : (x)\nfactor bbbb : (y)\n")
+	assert(t, "Include kept", "include \"common.plot\"\nfactor été  : (x)\nfactor bbbb : (y)\n", got)
+}
+
+func Test_Idempotent(t *testing.T) {
+	src := "factor a : (x, y) % a\nfactor longer : (0:3) = 1\n\n" +
+		"transition go : (a = x & longer < 3, choice : \"Go on, go on, go on, go on, go on.\", (a -> y, longer + 1))\n" +
+		"transition back : (a = y, spontaneous 0.25, a -> x)\n"
+	once := source(t, src)
+	assert(t, "Formatting twice changes nothing", once, source(t, once))
+	assert(t, "Wrapped transition", true, strings.Contains(once, "transition go : (\n"))
+}
+
+func Test_SyntaxError(t *testing.T) {
+	_, err := format.Source([]byte("factor sun (day, night)\n"), "story")
+	assert(t, "Syntax error", true, err != nil)
+}
+
+func Test_Text(t *testing.T) {
+	got := source(t, "description : (a = x, \"Say \\\"hi\\\" \\\\ go.\\nNext.\")\n"+
+		"ending e : (a = x, \"\"\"\n  One.\n    Two.\n\n  \"\"\")\n")
+	assert(t, "Escaped and triple-quoted", "description : (a = x, \"\"\"\n"+
+		"    Say \"hi\" \\\\ go.\n"+
+		"    Next.\n"+
+		"    \"\"\")\n"+
+		"ending e : (a = x, \"\"\"\n"+
+		"    One.\n"+
+		"      Two.\n"+
+		"\n"+
+		"    \"\"\")\n", got)
+	assert(t, "Text read back the same", got, source(t, got))
+
+	got = source(t, "description : (a = x, \"  Indented\\n  both.\")\n"+
+		"description : (a = x, \"Ends in \\\"\")\n")
+	assert(t, "Kept on one line", "description : (a = x, \"  Indented\\n  both.\")\n"+
+		"description : (a = x, \"Ends in \\\"\")\n", got)
+}
+
+func Test_Timed(t *testing.T) {
+	got := source(t, "transition back:(guard=gone,after 5,guard->here)\n"+
+		"transition bell:(sun=day,every  2,bells+1)\n"+
+		"transition noon:(sun=day,at turn 12,sun->noon)\n")
+	assert(t, "Timed schedules", "transition back : (guard = gone, after 5, guard -> here)\n"+
+		"transition bell : (sun = day, every 2, bells + 1)\n"+
+		"transition noon : (sun = day, at turn 12, sun -> noon)\n", got)
+}
+
+func Test_Outcomes(t *testing.T) {
+	got := source(t, "transition try:(door=shut,choice:\"Try.\",outcomes:0.7->(door->open,\"It opens.\"),0.3->(\"It's jammed.\"))\n"+
+		"transition t:(a=x,spontaneous 1,outcomes:1->(a->y),1->(a->z))\n")
+	assert(t, "Outcomes", "transition try : (\n"+
+		"    door = shut,\n"+
+		"    choice : \"Try.\",\n"+
+		"    outcomes :\n"+
+		"        0.7 -> (door -> open, \"It opens.\"),\n"+
+		"        0.3 -> (\"It's jammed.\")\n"+
+		")\n"+
+		"transition t : (a = x, spontaneous 1, outcomes : 1 -> (a -> y), 1 -> (a -> z))\n", got)
+	assert(t, "Formatting twice changes nothing", got, source(t, got))
+}
+
+func Test_Exclusive(t *testing.T) {
+	got := source(t, "option  settle\n"+
+		"transition ring:(a=x,spontaneous 0.5 priority 2,a->y)\n"+
+		"exclusive  jeanna:(ring,busy)\n")
+	assert(t, "Exclusive and priority", "option settle\n"+
+		"transition ring : (a = x, spontaneous 0.5 priority 2, a -> y)\n"+
+		"exclusive jeanna : (ring, busy)\n", got)
+}
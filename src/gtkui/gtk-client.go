@@ -21,34 +21,42 @@
 
 	The Go-GTK library was still young when Kieron wrote this, and has since
     changed.  It no longer works, and I don't know enough to fix it.  This is
-	a long term goal; for now, the text UI works fine.
+	a long term goal; for now, plotomaton play works fine.
 */
 
 package main
 
 import (
+	"cli"
+	"fmt"
 	"state"
 	"os"
 	"github.com/mattn/go-gtk/gtk"
 	"github.com/mattn/go-gtk/gdkpixbuf"
 	"path"
-	"rand"
 )
 
-//Setting up the universe shamelessly lifted from Kevin's textui example.
-var u = state.NewSampleUniverse()
-var s = u.Instantiate()
-var r = rand.New(rand.NewSource(rand.Int63()))
-var log = s.Now()
-var choices = s.ChosenTransitions()
+// The story being played, set up in main.
+var u *state.Universe
+var s *state.State
+var r *state.RNG
+var log *state.Moment
+var choices []*state.Transition
 
 func updateChoice(k int, buttons []*gtk.GtkButton, textview *gtk.GtkTextView) {
-	var end gtk.GtkTextIter
-	buffer := textview.GetBuffer()
-// 	buffer.GetStartIter(&start)
-	buffer.GetEndIter(&end)
-// 	buffer.Delete(&start, &end)
-	
+	if s.Ended() {
+		// The buttons are Start Again and Undo
+		m := s.Beginning().EndOfTurn()
+		if k == 1 {
+			m = s.Now().LastChoice().Past()
+		}
+		s.Goto(m)
+		log = m
+		describe(textview)
+		updateButtons(buttons)
+		return
+	}
+
 	choices = s.ChosenTransitions()
 
 	if !(k-1 < len(choices)) {
@@ -59,23 +67,31 @@ func updateChoice(k int, buttons []*gtk.GtkButton, textview *gtk.GtkTextView) {
 		choices[k-1].Apply(s)
 	}
 
-	s.RunSpontaneous(r)
+	s.RunSpontaneous(r.Rand)
 
-	for {
-		log = log.Future()
+	describe(textview)
+	updateButtons(buttons)
+}
 
-		if cause := log.Cause(); cause != nil {
-			//buffer.SetText(cause.Description())
-			buffer.Insert(&end, "\n\n")
-			buffer.Insert(&end, cause.Description())
-			buffer.GetEndIter(&end)
-			textview.ScrollToIter(&end, 0.1, true, 0.4, 0.4)
-		}
-		if log == s.Now() {
-			break
-		}
+// Adds everything that's happened since log to the text, then how things are
+// now, and the ending if the story is over.
+func describe(textview *gtk.GtkTextView) {
+	var end gtk.GtkTextIter
+	buffer := textview.GetBuffer()
+	buffer.GetEndIter(&end)
+
+	texts := s.Transcript(log)
+	log = s.Now()
+	for _, text := range texts {
+		buffer.Insert(&end, "\n\n")
+		buffer.Insert(&end, text)
+		buffer.GetEndIter(&end)
+		textview.ScrollToIter(&end, 0.1, true, 0.4, 0.4)
 	}
+}
 
+// Shows the choices available now on the buttons.
+func updateButtons(buttons []*gtk.GtkButton) {
 	choices := s.ChosenTransitions()
 
 	for _, t := range buttons {
@@ -83,20 +99,64 @@ func updateChoice(k int, buttons []*gtk.GtkButton, textview *gtk.GtkTextView) {
 		t.Hide()
 	}
 
+	if s.Ended() {
+		buttons[0].SetLabel("Start Again")
+		buttons[0].Show()
+		if s.Now().LastChoice() != nil {
+			buttons[1].SetLabel("Undo")
+			buttons[1].Show()
+		}
+		return
+	}
+
 	buttons[0].SetLabel("Do Nothing")
 	buttons[0].Show()
 
 	for i, t := range choices {
 		if i+1 < len(buttons) {
-			buttons[i+1].SetLabel(t.ChoiceDescription())
+			buttons[i+1].SetLabel(t.Choice(s))
 			buttons[i+1].Show()
 		}
 	}
 }
 
-func main() {
+// Carries on with the game saved in the named file.
+func loadGame(name string) error {
+	ls, lr, err := state.LoadFile(u, name)
+	if err != nil {
+		return err
+	}
+	s, r, log = ls, lr, ls.Now()
+	return nil
+}
 
-	s.RunSpontaneous(r)
+// Pops up an error message over the main window.
+func showError(window *gtk.GtkWindow, message string) {
+	dialog := gtk.MessageDialog(window, gtk.GTK_DIALOG_MODAL, gtk.GTK_MESSAGE_ERROR, gtk.GTK_BUTTONS_OK, message)
+	dialog.Run()
+	dialog.Destroy()
+}
+
+func main() {
+	// The same flags as plotomaton play.  This can't be one of plotomaton's
+	// subcommands, as then plotomaton couldn't be built without GTK.
+	flags := cli.NewStoryFlags("gtk-client", true)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gtk-client [flags] story\n")
+		flags.PrintDefaults()
+	}
+	u = flags.Story(os.Args[1:])
+	if u == nil {
+		os.Exit(1)
+	}
+	flags.PickSeed()
+	var err error
+	s, r, err = flags.Play(u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	log = s.Beginning()
 
 	var menuitem *gtk.GtkMenuItem
 	gtk.Init(nil)
@@ -140,16 +200,7 @@ func main() {
 	buffer.GetEndIter(&end)
 	buffer.Delete(&start, &end)
 
-	for {
-		log = log.Future()
-
-		if cause := log.Cause(); cause != nil {
-			buffer.SetText(cause.Description())
-		}
-		if log == s.Now() {
-			break
-		}
-	}
+	describe(textview)
 
 	swin.Add(textview)
 
@@ -175,6 +226,34 @@ func main() {
 	submenu := gtk.Menu()
 	cascademenu.SetSubmenu(submenu)
 
+	menuitem = gtk.MenuItemWithMnemonic("_Save")
+	menuitem.Connect("activate", func() {
+		dialog := gtk.FileChooserDialog("Save Game", window, gtk.GTK_FILE_CHOOSER_ACTION_SAVE, gtk.GTK_STOCK_SAVE, int(gtk.GTK_RESPONSE_ACCEPT))
+		if dialog.Run() == int(gtk.GTK_RESPONSE_ACCEPT) {
+			if err := state.SaveFile(dialog.GetFilename(), s, r); err != nil {
+				showError(window, "Couldn't save: "+err.Error())
+			}
+		}
+		dialog.Destroy()
+	})
+	submenu.Append(menuitem)
+
+	menuitem = gtk.MenuItemWithMnemonic("_Load")
+	menuitem.Connect("activate", func() {
+		dialog := gtk.FileChooserDialog("Load Game", window, gtk.GTK_FILE_CHOOSER_ACTION_OPEN, gtk.GTK_STOCK_OPEN, int(gtk.GTK_RESPONSE_ACCEPT))
+		if dialog.Run() == int(gtk.GTK_RESPONSE_ACCEPT) {
+			if err := loadGame(dialog.GetFilename()); err != nil {
+				showError(window, "Couldn't load: "+err.Error())
+			} else {
+				buffer.SetText("")
+				describe(textview)
+				updateButtons(buttons)
+			}
+		}
+		dialog.Destroy()
+	})
+	submenu.Append(menuitem)
+
 	menuitem = gtk.MenuItemWithMnemonic("E_xit")
 	menuitem.Connect("activate", func() {
 		gtk.MainQuit()
@@ -883,20 +962,7 @@ Public License instead of this License.  But first, please read
 	window.SetSizeRequest(600, 400)
 	window.ShowAll()
 
-	for _, t := range buttons {
-		t.SetLabel("")
-		t.Hide()
-	}
-
-	buttons[0].SetLabel("Do Nothing")
-	buttons[0].Show()
-
-	for i, t := range choices {
-		if i+1 < len(buttons) {
-			buttons[i+1].SetLabel(t.ChoiceDescription())
-			buttons[i+1].Show()
-		}
-	}
+	updateButtons(buttons)
 
 	gtk.Main()
 }
@@ -18,19 +18,29 @@
     Author - Sean Anderson
     Contact: fnordit@gmail.com
 
-	This is the parser for Plotomaton.  It's a basic recusive descent parser 
-	that directly calls initialization functions in the state package, then 
-	hands off the initialized game state to the UI to allow interaction with.
+	This is the parser for Plotomaton.  It's a basic recusive descent parser
+	that builds a syntax tree of the story, which the compile package then
+	turns into a Universe for the UI to allow interaction with.
 */
 
 package parser
 
 import (
 	"os"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"fmt"
 	"bufio"
 	"bytes"
+	"ast"
+	"compile"
 	"state"
+	"strings"
 	"strconv"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -46,27 +56,342 @@ const (
 	FLOAT          = 136
 )
 
-var file_reader *(bufio.Reader)
-var current_token byte
-var current_string string
-var current_int int
-var current_float float64
+// A Parser reads one story definition into an ast.File, and builds a
+// Universe from that.  All of
+// the lexer's state lives here, so separate Parsers can be used at once.
+type Parser struct {
+	file_reader    *(bufio.Reader)
+	current_token  byte
+	current_string string
+	current_int    int
+	current_float  float64
 
-func error() {
+	// Position bookkeeping for error messages.  current_pos is where the
+	// current token starts; line and column are where the next byte will be
+	// read from.
+	filename    string
+	current_pos Position
+	line        int
+	column      int
+	last_column int
+	last_byte   byte
+	source      bytes.Buffer
+	errors      ErrorList
+	last_pos    Position
 
+	file *ast.File
+
+	// Where included files are read from: fsys, or the OS if it's nil.
+	// sources holds the text of every file read so far, for error
+	// messages, and is shared with the Parsers of included files.
+	fsys    fs.FS
+	sources map[string]string
+
+	// Set NoValidate to skip checking the finished Universe with
+	// Universe.Validate.
+	NoValidate bool
+}
+
+// A Position is a location in a story file.  Lines and columns count from 1.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// An Error is a single problem found while parsing.  Source holds the text of
+// the offending line, for showing the writer where things went wrong.  Most
+// errors are something unexpected turning up, but if Msg is set, it says
+// what's wrong instead of Expected and Found.
+type Error struct {
+	Pos      Position
+	Expected string
+	Found    string
+	Msg      string
+	Source   string
 }
 
-func Match(b byte) {
-	if b != current_token {
-		error()
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%v: expected %s, found %s", e.Pos, e.Expected, e.Found)
+	if e.Msg != "" {
+		msg = fmt.Sprintf("%v: %s", e.Pos, e.Msg)
+	}
+	if e.Source != "" && e.Pos.Column > 0 {
+		msg += "\n\t" + e.Source + "\n\t" + caretIndent(e.Source, e.Pos.Column) + "^"
+	}
+	return msg
+}
+
+// Whitespace that lines up with column col of line, keeping its tabs.
+func caretIndent(line string, col int) string {
+	var indent []rune
+	for _, r := range line {
+		if len(indent) == col-1 {
+			break
+		}
+		if r != '\t' {
+			r = ' '
+		}
+		indent = append(indent, r)
+	}
+	return string(indent) + strings.Repeat(" ", col-1-len(indent))
+}
+
+// An ErrorList is every Error found in one parse, in source order.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// bailout is panicked by fail() to abandon the current declaration; AllFile
+// recovers it and skips ahead to the next one.
+type bailout struct{}
+
+// Records that something other than what we expected turned up.  Only the
+// first problem at any one place is worth reporting, as the rest are usually
+// knock-on effects of it.
+func (p *Parser) report(expected string) {
+	if n := len(p.errors); n > 0 && p.errors[n-1].Pos == p.current_pos {
+		return
+	}
+	p.errors = append(p.errors, &Error{Pos: p.current_pos, Expected: expected, Found: p.TokenString(p.current_token)})
+}
+
+func (p *Parser) fail(expected string) {
+	p.report(expected)
+	panic(bailout{})
+}
+
+func (p *Parser) Match(b byte) {
+	if b != p.current_token {
+		p.fail(p.TokenString(b))
 	} else {
-		current_token = GetNextToken()
+		p.last_pos = p.current_pos
+		p.current_token = p.GetNextToken()
 	}
 	return
 }
 
+// Whether the current token is the name word.  Words that are only keywords
+// in one place, like the "after" of a schedule, are read as names and
+// checked for there, so that stories can still use them as names elsewhere.
+func (p *Parser) isWord(word string) bool {
+	return p.current_token == STRING && p.current_string == word
+}
+
+// Matches the name word, which is a keyword here.
+func (p *Parser) MatchWord(word string) {
+	if !p.isWord(word) {
+		p.fail("'" + word + "'")
+	}
+	p.Match(STRING)
+}
+
+// Describes a token for error messages, including its value if it has one.
+func (p *Parser) TokenString(b byte) string {
+	switch b {
+	case EOF:
+		return "end of file"
+	case INT:
+		if b == p.current_token {
+			return "number " + strconv.Itoa(p.current_int)
+		}
+		return "number"
+	case FLOAT:
+		if b == p.current_token {
+			return "number " + strconv.FormatFloat(p.current_float, 'g', -1, 64)
+		}
+		return "number"
+	case STRING:
+		if b == p.current_token {
+			return "name " + strconv.Quote(p.current_string)
+		}
+		return "name"
+	case STRING_LITERAL:
+		if b == p.current_token {
+			return "text " + strconv.Quote(p.current_string)
+		}
+		return "quoted text"
+	case FACTOR:
+		return "'factor'"
+	case TRANSITION:
+		return "'transition'"
+	case DESCRIPTION:
+		return "'description'"
+	case SPONTANEOUS:
+		return "'spontaneous'"
+	case CHOICE:
+		return "'choice'"
+	case 0:
+		return "character " + strconv.Quote(p.current_string)
+	}
+	return strconv.QuoteRune(rune(b))
+}
+
+// Reads a byte from the input, keeping track of the line and column.
+func (p *Parser) readByte() (byte, error) {
+	b, err := p.file_reader.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	p.last_byte, p.last_column = b, p.column
+	if b == '\n' {
+		p.line++
+		p.column = 1
+	} else if !utf8.RuneStart(b) {
+		// Columns count characters, not the bytes they're made of
+	} else {
+		p.column++
+	}
+	return b, nil
+}
+
+// Puts back the byte just read.  Only one byte may be put back at a time.
+func (p *Parser) unreadByte() {
+	if p.file_reader.UnreadByte() != nil {
+		return
+	}
+	if p.last_byte == '\n' {
+		p.line--
+	}
+	p.column = p.last_column
+}
+
+// Whether c can be part of a name.  Any byte of a non-ASCII character counts:
+// whether it's really a letter is checked once the whole name has been read.
 func IsAlpha(c byte) bool {
-	return ((c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || c == '_')
+	return ((c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || c == '_' || c >= utf8.RuneSelf)
+}
+
+// Records a problem with the text of the story itself, rather than with the
+// tokens in it.
+func (p *Parser) lexError(pos Position, msg string) {
+	p.errors = append(p.errors, &Error{Pos: pos, Msg: msg})
+}
+
+// Reads the rest of a string literal, after its opening quote.  Returns false
+// if the file ends first.
+func (p *Parser) stringLiteral() (string, bool) {
+	start := p.current_pos
+	current_byte, err := p.readByte()
+	if err == nil && current_byte == '"' {
+		current_byte, err = p.readByte()
+		if err == nil && current_byte == '"' {
+			return p.tripleQuoted()
+		}
+		// Just ""
+		if err == nil {
+			p.unreadByte()
+		}
+		return "", true
+	}
+
+	text := bytes.NewBuffer(make([]byte, 0, 80))
+	for err == nil && current_byte != '"' {
+		if current_byte == '\\' {
+			p.escape(text)
+		} else if current_byte != '\r' {
+			text.WriteByte(current_byte)
+		}
+		current_byte, err = p.readByte()
+	}
+	if err != nil {
+		p.lexError(start, "text is missing its closing quote")
+		return "", false
+	}
+	return text.String(), true
+}
+
+// Reads the rest of a """triple-quoted""" string, which can have lines of
+// its own.  The line break after the opening quotes and the indentation of
+// the closing quotes are left out, as is the indentation every line shares,
+// so that the text can be indented along with the rest of the story.
+func (p *Parser) tripleQuoted() (string, bool) {
+	start := p.current_pos
+	text := bytes.NewBuffer(make([]byte, 0, 200))
+	current_byte, err := p.readByte()
+	for err == nil {
+		if current_byte == '"' {
+			quotes := 1
+			for quotes < 3 {
+				current_byte, err = p.readByte()
+				if err != nil || current_byte != '"' {
+					break
+				}
+				quotes++
+			}
+			if quotes == 3 {
+				return dedent(text.String()), true
+			}
+			text.WriteString(strings.Repeat("\"", quotes))
+			continue
+		}
+		if current_byte == '\\' {
+			p.escape(text)
+		} else if current_byte != '\r' {
+			text.WriteByte(current_byte)
+		}
+		current_byte, err = p.readByte()
+	}
+	p.lexError(start, "text is missing its closing quotes")
+	return "", false
+}
+
+// Reads the character after a backslash in text, and writes what it stands
+// for.
+func (p *Parser) escape(text *bytes.Buffer) {
+	pos := Position{p.filename, p.line, p.column - 1}
+	current_byte, err := p.readByte()
+	switch {
+	case err != nil:
+	case current_byte == 'n':
+		text.WriteByte('\n')
+	case current_byte == '"' || current_byte == '\\':
+		text.WriteByte(current_byte)
+	default:
+		p.unreadByte()
+		p.lexError(pos, "unknown escape in text, expected \\\" \\\\ or \\n")
+	}
+}
+
+// Takes the layout of a triple-quoted string out of its text.
+func dedent(text string) string {
+	lines := strings.Split(text, "\n")
+	if len(lines) > 1 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) > 1 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	common := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if common < 0 || indent < common {
+			common = indent
+		}
+	}
+	for i, line := range lines {
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if n > common {
+			n = common
+		}
+		if n > 0 {
+			lines[i] = line[n:]
+		}
+	}
+	return strings.Join(lines, "\n")
 }
 
 func IsNum(c byte) bool {
@@ -74,343 +399,797 @@ func IsNum(c byte) bool {
 }
 
 // Gets the next parsable token and returns its type, stores its value
-func GetNextToken() byte {
-	current_byte, err := file_reader.ReadByte()
+func (p *Parser) GetNextToken() byte {
+	p.current_pos = Position{p.filename, p.line, p.column}
+	current_byte, err := p.readByte()
 	if err != nil {
 		return EOF
 	} else {
 		switch current_byte {
-		case ' ', '\n':
-			return GetNextToken()
-		case ':', '(', ')', ',', '<', '>', '=', '-', '\\', '+', '|', '&':
+		case ' ', '\n', '\t', '\r':
+			return p.GetNextToken()
+		case ':', '(', ')', ',', '<', '>', '=', '-', '\\', '+', '|', '&', '!':
 			return current_byte
-        case '%':
-            for (current_byte != '\n') {
-                current_byte, err = file_reader.ReadByte()
-            }
-            return GetNextToken()
+		case '%':
+			// Comments are kept, so that the story can be printed back out
+			pos := p.pos()
+			comment := bytes.NewBuffer(make([]byte, 0, 80))
+			for current_byte != '\n' && err == nil {
+				comment.WriteByte(current_byte)
+				current_byte, err = p.readByte()
+			}
+			p.file.Comments = append(p.file.Comments, &ast.Comment{Pos: pos, Text: comment.String()})
+			return p.GetNextToken()
 		case '"':
-			current_buffer := bytes.NewBuffer(make([]byte, 0, 80))
-			current_byte, _ := file_reader.ReadByte()
-			for current_byte != '"' {
-				current_buffer.WriteByte(current_byte)
-				current_byte, _ = file_reader.ReadByte()
+			text, ok := p.stringLiteral()
+			if !ok {
+				return EOF
 			}
-			current_string = current_buffer.String()
+			p.current_string = text
 			return STRING_LITERAL
 		}
 		if IsNum(current_byte) || current_byte == '.' {
 			// current_byte is a digit - react accordingly
-			current_int = 0
+			p.current_int = 0
 			for IsNum(current_byte) {
-				current_int *= 10
-				current_int += (int(current_byte) - 48)
-				current_byte, err = file_reader.ReadByte()
+				p.current_int *= 10
+				p.current_int += (int(current_byte) - 48)
+				current_byte, err = p.readByte()
 			}
-			current_float = float64(current_int)
+			p.current_float = float64(p.current_int)
 
 			if current_byte == '.' {
-				dec_place := 0.1
-				current_byte, err = file_reader.ReadByte()
-				for IsNum(current_byte) {
-					current_float += float64(int(current_byte) - 48)*dec_place
-					dec_place /= 10
-					current_byte, err = file_reader.ReadByte()
+				// Read the digits as written, so that 0.3 is as near 0.3 as
+				// a float64 gets
+				digits := strconv.Itoa(p.current_int) + "."
+				current_byte, err = p.readByte()
+				for IsNum(current_byte) && err == nil {
+					digits += string(current_byte)
+					current_byte, err = p.readByte()
+				}
+				p.current_float, _ = strconv.ParseFloat(digits, 64)
+				if err == nil {
+					p.unreadByte()
 				}
-				file_reader.UnreadByte()
 				return FLOAT
 			}
 
-			file_reader.UnreadByte()
+			if err == nil {
+				p.unreadByte()
+			}
 			return INT
 		} else if IsAlpha(current_byte) {
 			// current_byte is a letter
 			current_buffer := bytes.NewBuffer(make([]byte, 0, 80))
 			for IsAlpha(current_byte) || IsNum(current_byte) {
 				current_buffer.WriteByte(current_byte)
-				current_byte, err = file_reader.ReadByte()
+				current_byte, err = p.readByte()
+			}
+			if err == nil {
+				p.unreadByte()
+			}
+			p.current_string = current_buffer.String()
+			for _, r := range p.current_string {
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) {
+					p.lexError(p.current_pos, "name has "+strconv.QuoteRune(r)+" in it, which isn't a letter or digit")
+					break
+				}
 			}
-			file_reader.UnreadByte()
-			current_string = current_buffer.String()
 			switch {
-			case current_string == "factor":
+			case p.current_string == "factor":
 				return FACTOR
-			case current_string == "transition":
+			case p.current_string == "transition":
 				return TRANSITION
-			case current_string == "description":
+			case p.current_string == "description":
 				return DESCRIPTION
-			case current_string == "spontaneous":
+			case p.current_string == "spontaneous":
 				return SPONTANEOUS
-			case current_string == "choice":
+			case p.current_string == "choice":
 				return CHOICE
 			default:
 				return STRING
 			}
 		}
 	}
+	p.current_string = string(current_byte)
 	return 0
 }
 
-var u *state.Universe
+// Makes a Parser that reads a story from r.  The name is used in error
+// messages, and is usually the name of the file r was opened from.
+func NewParser(r io.Reader, name string) *Parser {
+	p := &Parser{filename: name, line: 1, column: 1}
+	p.file_reader = bufio.NewReader(io.TeeReader(r, &p.source))
+	p.file = &ast.File{Name: name}
+	p.sources = map[string]string{}
+	return p
+}
+
+// Where the current token starts, for the syntax tree.
+func (p *Parser) pos() ast.Pos {
+	return ast.Pos{Line: p.current_pos.Line, Column: p.current_pos.Column}
+}
 
-// Reads the text file and starts the process
-func ParseFile(filename string) *state.Universe {
-	f, err := os.Open(filename)
-	file_reader = bufio.NewReader(f)
+// Reads the whole story and builds a Universe from it.  If the story has any
+// errors in it, they are all returned as an ErrorList, and no Universe is
+// returned.  Unless NoValidate is set, the Universe is then checked with
+// Validate; if that only finds warnings, the Universe is returned along with
+// them.  A Parser can only be used once.
+func (p *Parser) Parse() (*state.Universe, error) {
+	f, err := p.ParseAST()
+	if err != nil {
+		return nil, err
+	}
+	name := p.clean(p.filename)
+	if errs := p.readIncludes(f, []string{name}, map[string]bool{name: true}); len(errs) > 0 {
+		return nil, errs
+	}
+	u, m, err := compile.Compile(f)
 	if err != nil {
-		return nil
+		p.compileErrors(err)
+		return nil, p.errorList()
 	}
+	if !p.NoValidate {
+		if err := u.Validate(); err != nil {
+			errs := err.(state.ValidationErrors)
+			m.Locate(errs)
+			if errs.Fatal() {
+				return nil, errs
+			}
+			return u, errs
+		}
+	}
+	return u, nil
+}
 
-	defer f.Close()
+// Adds the errors from compiling to the parser's own.
+func (p *Parser) compileErrors(err error) {
+	for _, e := range err.(compile.ErrorList) {
+		p.errors = append(p.errors, &Error{Pos: Position{e.Filename, e.Pos.Line, e.Pos.Column}, Expected: e.Expected, Found: e.Found})
+	}
+}
+
+// Reads the whole story into a syntax tree, without looking up any names,
+// so only syntax errors are found.  They are returned as an ErrorList.
+func (p *Parser) ParseAST() (*ast.File, error) {
+	p.current_token = p.GetNextToken()
+	p.AllFile()
+
+	if len(p.errors) > 0 {
+		return nil, p.errorList()
+	}
+	return p.file, nil
+}
+
+// The errors found so far, with the lines they were found on.
+func (p *Parser) errorList() ErrorList {
+	for _, e := range p.errors {
+		src, ok := p.sources[e.Pos.Filename]
+		if !ok {
+			src = p.source.String()
+		}
+		lines := strings.Split(src, "\n")
+		if e.Pos.Line <= len(lines) {
+			e.Source = strings.TrimRight(lines[e.Pos.Line-1], "\r")
+		}
+	}
+	return p.errors
+}
+
+func (p *Parser) clean(name string) string {
+	if p.fsys != nil {
+		return path.Clean(name)
+	}
+	return filepath.Clean(name)
+}
+
+// The name of the file that include "inc" in the file from refers to.
+func (p *Parser) resolve(from string, inc string) string {
+	if p.fsys != nil {
+		return path.Join(path.Dir(from), inc)
+	}
+	if filepath.IsAbs(inc) {
+		return filepath.Clean(inc)
+	}
+	return filepath.Join(filepath.Dir(from), inc)
+}
+
+func (p *Parser) openFile(name string) (io.ReadCloser, error) {
+	if p.fsys != nil {
+		return p.fsys.Open(name)
+	}
+	return os.Open(name)
+}
+
+// Reads the files that f, the file this Parser read, includes, and then the
+// ones they include, filling in each IncludeDecl's File.  Each file is only
+// read once, so that two chapters can both include the factors they share.
+// stack is the chain of files that led to f, for finding files that end up
+// including themselves.  Returns every error from every file.
+func (p *Parser) readIncludes(f *ast.File, stack []string, seen map[string]bool) ErrorList {
+	var errs ErrorList
+	for _, d := range f.Decls {
+		d, ok := d.(*ast.IncludeDecl)
+		if !ok {
+			continue
+		}
+		name := p.resolve(stack[len(stack)-1], d.Path)
+		problem := func(msg string) {
+			p.errors = append(p.errors, &Error{Pos: Position{p.filename, d.Pos.Line, d.Pos.Column}, Msg: msg})
+		}
+		cycle := false
+		for _, s := range stack {
+			cycle = cycle || s == name
+		}
+		if cycle {
+			problem("include cycle: " + strings.Join(append(stack, name), " includes "))
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
 
-	u = state.NewUniverse()
+		r, err := p.openFile(name)
+		if err != nil {
+			problem("can't include " + strconv.Quote(d.Path) + ": " + err.Error())
+			continue
+		}
+		sub := NewParser(r, name)
+		sub.fsys, sub.sources = p.fsys, p.sources
+		d.File, err = sub.ParseAST()
+		r.Close()
+		p.sources[name] = sub.source.String()
+		if err != nil {
+			errs = append(errs, err.(ErrorList)...)
+			continue
+		}
+		errs = append(errs, sub.readIncludes(d.File, append(stack[:len(stack):len(stack)], name), seen)...)
+	}
+	if len(p.errors) > 0 {
+		errs = append(p.errorList(), errs...)
+	}
+	return errs
+}
 
-	current_token = GetNextToken()
-	AllFile()
-	return u
+// Reads a condition about the factors of u, written the same way as in a
+// transition, for code that wants to ask about a story from outside it.
+func ParseCondition(u *state.Universe, src string) (state.BoolExpr, error) {
+	p := NewParser(strings.NewReader(src), "condition")
+	e := p.condition()
+	if len(p.errors) > 0 {
+		return nil, p.errorList()
+	}
+	b, err := compile.Expr(u, e, p.filename)
+	if err != nil {
+		p.compileErrors(err)
+		return nil, p.errorList()
+	}
+	return b, nil
 }
 
-func AllFile() {
-	for current_token != EOF {
-		switch current_token {
-		case FACTOR:
-			Match(FACTOR)
-			Factor()
-		case TRANSITION:
-			Match(TRANSITION)
-			Transition()
-		case DESCRIPTION:
-			Match(DESCRIPTION)
-			Description()
+// Reads everything the Parser has as a single condition.
+func (p *Parser) condition() (e ast.Expr) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
 		}
+	}()
+	p.current_token = p.GetNextToken()
+	e = p.Conjunction()
+	if p.current_token != EOF {
+		p.fail("end of condition")
+	}
+	return e
+}
+
+// Reads a story from r.  The name is used in error messages.
+func ParseReader(r io.Reader, name string) (*state.Universe, error) {
+	return NewParser(r, name).Parse()
+}
+
+// Reads a story held in a string, for stories built by other code.
+func ParseString(src string, name string) (*state.Universe, error) {
+	return ParseReader(strings.NewReader(src), name)
+}
+
+// Reads the named story out of fsys, so that stories can be embedded in the
+// binary or kept somewhere other than the OS filesystem.
+func ParseFS(fsys fs.FS, name string) (*state.Universe, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := NewParser(f, name)
+	p.fsys = fsys
+	return p.Parse()
+}
+
+// Reads the text file and starts the process
+func ParseFile(name string) (*state.Universe, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseReader(f, name)
+}
+
+func (p *Parser) AllFile() {
+	for p.current_token != EOF {
+		p.Declaration()
 	}
 
 	return
 }
 
-func Factor() {
-	//var initial string
-	name := FactorName()
-	Match(':')
-	Match('(')
-	values := FactorValues()
-	u.AddFactor(name, values[0], values)
-	Match(')')
+// Parses one top level declaration.  If it has an error, skips ahead to
+// whatever looks like the start of the next one, so that we can keep going
+// and report everything wrong with the file in one go.
+func (p *Parser) Declaration() {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+			p.SkipToDeclaration()
+		}
+	}()
+
+	pos := p.pos()
+	switch p.current_token {
+	case FACTOR:
+		p.Match(FACTOR)
+		d := p.Factor()
+		d.Pos, d.End = pos, p.last_pos.Line
+		p.file.Decls = append(p.file.Decls, d)
+	case TRANSITION:
+		p.Match(TRANSITION)
+		d := p.Transition()
+		d.Pos, d.End = pos, p.last_pos.Line
+		p.file.Decls = append(p.file.Decls, d)
+	case DESCRIPTION:
+		p.Match(DESCRIPTION)
+		d := p.Description()
+		d.Pos, d.End = pos, p.last_pos.Line
+		p.file.Decls = append(p.file.Decls, d)
+	case STRING:
+		if p.isWord("include") {
+			p.Match(STRING)
+			d := &ast.IncludeDecl{Pos: pos, Path: p.current_string}
+			p.Match(STRING_LITERAL)
+			d.End = p.last_pos.Line
+			p.file.Decls = append(p.file.Decls, d)
+		} else if p.isWord("ending") {
+			p.Match(STRING)
+			d := p.Ending()
+			d.Pos, d.End = pos, p.last_pos.Line
+			p.file.Decls = append(p.file.Decls, d)
+		} else if p.isWord("exclusive") {
+			p.Match(STRING)
+			d := p.Exclusive()
+			d.Pos, d.End = pos, p.last_pos.Line
+			p.file.Decls = append(p.file.Decls, d)
+		} else if p.isWord("option") {
+			p.Match(STRING)
+			d := &ast.OptionDecl{Pos: pos, Name: p.current_string}
+			p.Match(STRING)
+			d.End = p.last_pos.Line
+			p.file.Decls = append(p.file.Decls, d)
+		} else {
+			p.badDeclaration()
+		}
+	default:
+		p.badDeclaration()
+	}
+}
+
+func (p *Parser) badDeclaration() {
+	p.report("'factor', 'transition', 'description', 'ending', 'include', 'exclusive' or 'option'")
+	p.current_token = p.GetNextToken()
+	p.SkipToDeclaration()
+}
+
+// Skips to the next declaration.  include, ending, exclusive and option are
+// names everywhere else, so they're only taken to start one at the beginning
+// of a line.
+func (p *Parser) SkipToDeclaration() {
+	for p.current_token != EOF && p.current_token != FACTOR && p.current_token != TRANSITION && p.current_token != DESCRIPTION &&
+		!(p.declarationWord() && p.current_pos.Column == 1) {
+		p.current_token = p.GetNextToken()
+	}
+}
+
+// Whether the current token is a name that can start a declaration.
+func (p *Parser) declarationWord() bool {
+	for _, w := range []string{"include", "ending", "exclusive", "option"} {
+		if p.isWord(w) {
+			return true
+		}
+	}
+	return false
 }
 
-func FactorName() string {
+func (p *Parser) Factor() *ast.FactorDecl {
+	d := &ast.FactorDecl{Name: p.FactorName()}
+	p.Match(':')
+	p.Match('(')
+	if p.current_token == INT || p.current_token == '-' {
+		// A numeric factor, declared as a range MIN:MAX
+		d.Numeric = true
+		d.Min = p.Integer()
+		p.Match(':')
+		d.Max = p.Integer()
+	} else {
+		d.Values = p.FactorValues()
+	}
+	p.Match(')')
+
+	// Without an explicit initial value, the first one is used
+	if p.current_token == '=' || p.current_token == STRING && p.current_string == "initial" {
+		p.Match(p.current_token)
+		d.InitialPos = p.pos()
+		d.Initial = p.ComparedValue()
+	}
+	return d
+}
+
+func (p *Parser) FactorName() string {
 	var name string
-	if current_token == STRING {
-		name = current_string
-		Match(STRING)
+	if p.current_token == STRING {
+		name = p.current_string
+		p.Match(STRING)
 	} else {
-		error()
+		p.fail("factor name")
 	}
 	return name
 }
 
-func FactorValues() []string {
-	vals := make([]string, 1)
-	if current_token == STRING {
-		vals[0] = FactorValue()
-		if current_token == ',' {
-			Match(',')
-			vals = append(vals, FactorValues()...)
-		}
-	} /* else if (current_token == INT) {
-	       first := current_int
-	       Match(INT)
-	       Match(':')
-	       second := current_int
-	       Match(INT)
-	   }
-	*/
+func (p *Parser) FactorValues() []string {
+	var vals []string
+	if p.current_token == STRING {
+		vals = append(vals, p.FactorValue())
+		if p.current_token == ',' {
+			p.Match(',')
+			vals = append(vals, p.FactorValues()...)
+		}
+	}
 	return vals
 }
 
-func FactorValue() string {
-	val := current_string
-	Match(STRING)
+// An integer, possibly negative.
+func (p *Parser) Integer() int {
+	sign := 1
+	if p.current_token == '-' {
+		p.Match('-')
+		sign = -1
+	}
+	n := p.current_int
+	p.Match(INT)
+	return sign * n
+}
+
+func (p *Parser) FactorValue() string {
+	val := p.current_string
+	p.Match(STRING)
 	return val
 }
 
-func Transition() {
-	Match(TRANSITION)
-	var name string
-	if current_token == STRING {
-		name = TransitionName()
-	} else {
-		name = ""
-	}
-	Match(':')
-	Match('(')
-	expression := Conjunction()
-	Match(',')
-	schedule := Schedule()
-	Match(',')
-	effects := FactorTransitions()
-	var description string
-	if current_token == ',' {
-		Match(',')
-		description = current_string
-		Match(STRING_LITERAL)
+func (p *Parser) Transition() *ast.TransitionDecl {
+	d := &ast.TransitionDecl{}
+	if p.current_token == STRING {
+		d.Name = p.TransitionName()
+	}
+	p.Match(':')
+	p.Match('(')
+	d.Condition = p.Conjunction()
+	p.Match(',')
+	d.Schedule = p.Schedule()
+	if p.isWord("priority") {
+		p.Match(STRING)
+		d.Priority = p.Integer()
+	}
+	p.Match(',')
+	if p.isWord("outcomes") {
+		// Unless it's followed by a ':', outcomes is the name of the
+		// factor the transition changes
+		e := &ast.Effect{Pos: p.pos(), Factor: p.FactorName()}
+		if p.current_token == ':' {
+			d.Outcomes = p.Outcomes()
+			p.Match(')')
+			return d
+		}
+		p.EffectOp(e)
+		d.Effects = []*ast.Effect{e}
 	} else {
-		description = ""
+		d.Effects = p.FactorTransitions()
+	}
+	if p.current_token == ',' {
+		p.Match(',')
+		d.Description = p.Text()
 	}
-	Match(')')
-	u.AddTransition(name, expression, schedule, description, effects)
+	p.Match(')')
+	return d
 }
 
-func Schedule() state.Schedule {
-	var ret state.Schedule
-	if current_token == SPONTANEOUS {
-		Match(SPONTANEOUS)
-		if current_token == INT {
-			ret = state.Spontaneous{float64(current_int)}
-			Match(INT)
-		} else {
-			ret = state.Spontaneous{current_float}
-			Match(FLOAT)
+// outcomes : WEIGHT -> (EFFECTS, "text"), WEIGHT -> (...), ..., from just
+// after the outcomes
+func (p *Parser) Outcomes() []*ast.Outcome {
+	p.Match(':')
+	outcomes := []*ast.Outcome{p.Outcome()}
+	for p.current_token == ',' {
+		p.Match(',')
+		outcomes = append(outcomes, p.Outcome())
+	}
+	return outcomes
+}
+
+// One outcome: its weight, then its effects and text in parentheses.  Either
+// can be left out, but not both.
+func (p *Parser) Outcome() *ast.Outcome {
+	o := &ast.Outcome{Pos: p.pos(), Weight: p.Number()}
+	p.Match('-')
+	p.Match('>')
+	p.Match('(')
+	if p.current_token == STRING_LITERAL {
+		o.Description = p.Text()
+		p.Match(')')
+		return o
+	}
+	o.Effects = append(o.Effects, p.FactorTransition())
+	for p.current_token == ',' {
+		p.Match(',')
+		if p.current_token == STRING_LITERAL {
+			o.Description = p.Text()
+			break
 		}
-	} else {
-		Match(CHOICE)
-		Match(':')
-		ret = state.Chosen{current_string}
-		Match(STRING_LITERAL)
+		o.Effects = append(o.Effects, p.FactorTransition())
+	}
+	p.Match(')')
+	return o
+}
+
+// A number, with or without a decimal point.
+func (p *Parser) Number() float64 {
+	if p.current_token == INT {
+		defer p.Match(INT)
+		return float64(p.current_int)
+	}
+	defer p.Match(FLOAT)
+	return p.current_float
+}
+
+func (p *Parser) Schedule() ast.Schedule {
+	pos := p.pos()
+	if p.current_token == SPONTANEOUS {
+		p.Match(SPONTANEOUS)
+		return &ast.Spontaneous{Pos: pos, Probability: p.Number()}
+	} else if p.current_token == CHOICE {
+		p.Match(CHOICE)
+		p.Match(':')
+		return &ast.Choice{Pos: pos, Text: p.Text()}
+	} else if p.isWord("after") {
+		p.Match(STRING)
+		return &ast.After{Pos: pos, Turns: p.Integer()}
+	} else if p.isWord("every") {
+		p.Match(STRING)
+		return &ast.Every{Pos: pos, Turns: p.Integer()}
+	} else if p.isWord("at") {
+		p.Match(STRING)
+		p.MatchWord("turn")
+		return &ast.AtTurn{Pos: pos, Turn: p.Integer()}
 	}
-	return ret
+	p.fail("'spontaneous', 'choice', 'after', 'every' or 'at'")
+	return nil
 }
 
-func TransitionName() string {
-	name := current_string
-	Match(STRING)
+func (p *Parser) TransitionName() string {
+	name := p.current_string
+	p.Match(STRING)
 	return name
 }
 
 // Boolean requirements for the execution of transitions
 // Written in conjunctive form - CLAUSE & CLAUSE & ...
-func Conjunction() state.BoolExpr {
-	var exps []state.BoolExpr
-	exps = append(exps, Disjunction())
-	for current_token == '&' {
-		Match('&')
-		exps = append(exps, Disjunction())
+func (p *Parser) Conjunction() ast.Expr {
+	exps := []ast.Expr{p.Disjunction()}
+	for p.current_token == '&' {
+		p.Match('&')
+		exps = append(exps, p.Disjunction())
 	}
-	return state.And{exps}
+	if len(exps) == 1 {
+		return exps[0]
+	}
+	return &ast.And{Clauses: exps}
 }
 
-func Disjunction() state.BoolExpr {
-	var exps []state.BoolExpr
-	exps = append(exps, Bool())
-	for current_token == '|' {
-		Match('|')
-		exps = append(exps, Bool())
+func (p *Parser) Disjunction() ast.Expr {
+	exps := []ast.Expr{p.Bool()}
+	for p.current_token == '|' {
+		p.Match('|')
+		exps = append(exps, p.Bool())
+	}
+	if len(exps) == 1 {
+		return exps[0]
 	}
-	return state.Or{exps}
+	return &ast.Or{Clauses: exps}
 }
 
-func Bool() state.BoolExpr {
-	if current_token == '(' {
-		Match('(')
-		exp := Conjunction()
-		Match(')')
-		return exp
-	} else {
-		fac := u.FindFactor(FactorName())
-		switch current_token {
-//		case '<':
-//			Match('<')
-//			if current_token == '=' {
-//				Match('=')
-//			}
-
-//			if current_token == INT {
-//				Match(INT)
-//			} else {
-//				FactorName()
-//			}
-//		case '>':
-//			Match('>')
-//			if current_token == '=' {
-//				Match('=')
-//			}
-
-//			if current_token == INT {
-//				Match(INT)
-//			} else {
-//				FactorName()
-//			}
-		case '=':
-			Match('=')
-			if current_token == INT {
-				exp := state.FactorEquals{fac, state.Value(strconv.Itoa(current_int))}
-				Match(INT)
-				return exp
-			} else {
-				exp := state.FactorEquals{fac, state.Value(current_string)}
-				Match(STRING)
-				return exp
-			}
+func (p *Parser) Bool() ast.Expr {
+	pos := p.pos()
+	if p.isWord("not") {
+		p.Match(STRING)
+		switch p.current_token {
+		case '=', '!', '<', '>':
+			// A factor called not
+			return p.Comparison(pos, "not")
+		}
+		return &ast.Not{Pos: pos, Clause: p.Bool()}
+	} else if p.current_token == '(' {
+		p.Match('(')
+		exp := p.Conjunction()
+		p.Match(')')
+		return &ast.Paren{Pos: pos, X: exp}
+	}
+	return p.Comparison(pos, p.FactorName())
+}
+
+// The rest of a condition on the factor fac, after its name.
+func (p *Parser) Comparison(pos ast.Pos, fac string) ast.Expr {
+	switch p.current_token {
+	case '<', '>':
+		op := string(rune(p.current_token))
+		p.Match(p.current_token)
+		if p.current_token == '=' {
+			p.Match('=')
+			op += "="
+		}
+		return &ast.Compare{Pos: pos, Factor: fac, Op: op, Value: strconv.Itoa(p.Integer())}
+	case '=':
+		p.Match('=')
+		return &ast.Compare{Pos: pos, Factor: fac, Op: "=", Value: p.ComparedValue()}
+	case '!':
+		p.Match('!')
+		p.Match('=')
+		return &ast.Compare{Pos: pos, Factor: fac, Op: "!=", Value: p.ComparedValue()}
+	case STRING:
+		if p.isWord("in") {
+			p.Match(STRING)
+			return &ast.In{Pos: pos, Factor: fac, Values: p.ValueSet()}
+		} else if p.isWord("not") {
+			p.Match(STRING)
+			p.MatchWord("in")
+			return &ast.In{Pos: pos, Factor: fac, Not: true, Values: p.ValueSet()}
 		}
 	}
+	p.fail("'=', '!=', '<', '>' or 'in'")
 	return nil
 }
 
-func FactorTransitions() map[*state.Factor]state.Value {
-	ret := make(map[*state.Factor]state.Value)
-	if current_token != '(' {
-		fac, val := FactorTransition()
-		ret[fac] = val
-	} else {
-		Match('(')
-		transitions := FactorTransitionList()
-		for fac, val := range(transitions) {
-			ret[fac] = val
-		}
-		Match(')')
-	}
-	return ret
-}
-
-func FactorTransitionList() map[*state.Factor]state.Value {
-	ret := make(map[*state.Factor]state.Value)
-	fac, val := FactorTransition()
-	ret[fac] = val
-	for current_token == ',' {
-		Match(',')
-		fac, val = FactorTransition()
-		ret[fac] = val
-	}
-	return ret
-}
-
-func FactorTransition() (*state.Factor, state.Value) {
-	fac := u.FindFactor(FactorName())
-	var val state.Value
-	if current_token == '-' {
-		Match('-')
-		if current_token == '>' {
-			Match('>')
-			val = state.Value(FactorValue())
-		}// else {
-//			Match(INT)
-//		}
-//	} else {
-//		Match('+')
-//		if current_token == INT {
-//			Match(INT)
-//		}
-	}
-	return fac, val
-}
-
-
-func Description() {
-	Match(':')
-	Match('(')
-	Conjunction()
-	Match(',')
-//	StringLiteral()
-	Match(STRING_LITERAL)
-	Match(')')
+// A value to compare a factor with, either a name or an integer.
+func (p *Parser) ComparedValue() string {
+	if p.current_token == INT || p.current_token == '-' {
+		return strconv.Itoa(p.Integer())
+	}
+	val := p.current_string
+	p.Match(STRING)
+	return val
+}
+
+// The set of values in FACTOR in (VALUE, VALUE, ...), which is short for
+// FACTOR = VALUE | FACTOR = VALUE | ...
+func (p *Parser) ValueSet() []string {
+	p.Match('(')
+	vals := []string{p.ComparedValue()}
+	for p.current_token == ',' {
+		p.Match(',')
+		vals = append(vals, p.ComparedValue())
+	}
+	p.Match(')')
+	return vals
+}
+
+// A transition's effects: values to set factors to, and numbers to add to
+// numeric factors.
+func (p *Parser) FactorTransitions() []*ast.Effect {
+	if p.current_token != '(' {
+		return []*ast.Effect{p.FactorTransition()}
+	}
+	p.Match('(')
+	effects := p.FactorTransitionList()
+	p.Match(')')
+	return effects
+}
+
+func (p *Parser) FactorTransitionList() []*ast.Effect {
+	effects := []*ast.Effect{p.FactorTransition()}
+	for p.current_token == ',' {
+		p.Match(',')
+		effects = append(effects, p.FactorTransition())
+	}
+	return effects
+}
+
+// One effect: FACTOR -> VALUE, FACTOR + INT or FACTOR - INT
+func (p *Parser) FactorTransition() *ast.Effect {
+	e := &ast.Effect{Pos: p.pos(), Factor: p.FactorName()}
+	p.EffectOp(e)
+	return e
+}
+
+// The rest of an effect, after its factor's name.
+func (p *Parser) EffectOp(e *ast.Effect) {
+	switch p.current_token {
+	case '-':
+		p.Match('-')
+		if p.current_token == '>' {
+			p.Match('>')
+			e.Op, e.Value = "->", p.ComparedValue()
+		} else if p.current_token == INT {
+			e.Op, e.Value = "-", strconv.Itoa(p.current_int)
+			p.Match(INT)
+		} else {
+			p.fail("'>' or number")
+		}
+	case '+':
+		p.Match('+')
+		e.Op, e.Value = "+", strconv.Itoa(p.current_int)
+		p.Match(INT)
+	default:
+		p.fail("'->', '+' or '-'")
+	}
+}
+
+func (p *Parser) Description() *ast.DescriptionDecl {
+	d := &ast.DescriptionDecl{}
+	p.Match(':')
+	p.Match('(')
+	d.Condition = p.Conjunction()
+	p.Match(',')
+	d.Text = p.Text()
+	p.Match(')')
+	return d
+}
+
+// exclusive NAME : (TRANSITION, TRANSITION, ...)
+func (p *Parser) Exclusive() *ast.ExclusiveDecl {
+	d := &ast.ExclusiveDecl{}
+	if p.current_token == STRING {
+		d.Name = p.current_string
+		p.Match(STRING)
+	}
+	p.Match(':')
+	p.Match('(')
+	d.Transitions = append(d.Transitions, p.Ref())
+	for p.current_token == ',' {
+		p.Match(',')
+		d.Transitions = append(d.Transitions, p.Ref())
+	}
+	p.Match(')')
+	return d
+}
+
+func (p *Parser) Ref() *ast.Ref {
+	r := &ast.Ref{Pos: p.pos(), Name: p.current_string}
+	p.Match(STRING)
+	return r
+}
+
+// ending NAME : (CONDITION, "text")
+func (p *Parser) Ending() *ast.EndingDecl {
+	d := &ast.EndingDecl{}
+	d.Name = p.current_string
+	p.Match(STRING)
+	p.Match(':')
+	p.Match('(')
+	d.Condition = p.Conjunction()
+	p.Match(',')
+	d.Text = p.Text()
+	p.Match(')')
+	return d
 }
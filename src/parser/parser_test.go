@@ -1,9 +1,15 @@
 package parser_test
 
 import (
+	"ast"
 	"parser"
-//    "state"
+	"state"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
     "testing"
+    "testing/fstest"
 )
 
 func assert(t *testing.T, name string, want interface{}, got interface{}) bool {
@@ -15,5 +21,563 @@ func assert(t *testing.T, name string, want interface{}, got interface{}) bool {
 }
 
 func Test_Parser(t *testing.T) {
-	parser.ParseFile("test")
+	u, err := parser.ParseFile("test")
+	assert(t, "No errors", nil, err)
+	assert(t, "Universe built", true, u != nil)
+}
+
+func Test_ParseErrors(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bad")
+	os.WriteFile(name, []byte("factor sun : (day, night\n"+
+		"factor loc : (a, b)\n"+
+		"transition t : (sun day, choice : \"x\", loc -> b)\n"), 0644)
+
+	u, err := parser.ParseFile(name)
+	assert(t, "No universe", true, u == nil)
+	errs, ok := err.(parser.ErrorList)
+	if assert(t, "Error list", true, ok) && assert(t, "Error count", 2, len(errs)) {
+		assert(t, "First line", 2, errs[0].Pos.Line)
+		assert(t, "First column", 1, errs[0].Pos.Column)
+		assert(t, "First expected", "')'", errs[0].Expected)
+		assert(t, "First found", "'factor'", errs[0].Found)
+		assert(t, "Second line", 3, errs[1].Pos.Line)
+		assert(t, "Second column", 21, errs[1].Pos.Column)
+		assert(t, "Second source", "transition t : (sun day, choice : \"x\", loc -> b)", errs[1].Source)
+	}
+}
+
+func Test_ParseAST(t *testing.T) {
+	f, err := parser.NewParser(strings.NewReader("% The sun\n"+
+		"factor sun : (day, night)\n"+
+		"transition set : (sun = day & moon = full, spontaneous 1, sun -> night) % dusk\n"), "story").ParseAST()
+	if !assert(t, "No errors for undeclared factor", nil, err) {
+		return
+	}
+	if assert(t, "Declarations", 2, len(f.Decls)) {
+		tr, ok := f.Decls[1].(*ast.TransitionDecl)
+		if assert(t, "Transition", true, ok) {
+			assert(t, "Name", "set", tr.Name)
+			assert(t, "Start", ast.Pos{Line: 3, Column: 1}, tr.Start())
+			if and, ok := tr.Condition.(*ast.And); assert(t, "Conjunction", true, ok) {
+				assert(t, "Clause position", 31, and.Clauses[1].Start().Column)
+			}
+		}
+	}
+	if assert(t, "Comments", 2, len(f.Comments)) {
+		assert(t, "Comment text", "% The sun", f.Comments[0].Text)
+		assert(t, "Trailing comment line", 3, f.Comments[1].Pos.Line)
+	}
+}
+
+func Test_ParseInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "rooms"), 0755)
+	os.WriteFile(filepath.Join(dir, "common.plot"), []byte("factor sun : (day, night)\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "rooms", "office.plot"), []byte("include \"../common.plot\"\n"+
+		"factor location : (Hall, Office)\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "story.plot"), []byte("include \"common.plot\"\n"+
+		"include \"rooms/office.plot\"\n"+
+		"transition dusk : (sun = day & location = Office, spontaneous 1, sun -> night)\n"), 0644)
+
+	u, err := parser.ParseFile(filepath.Join(dir, "story.plot"))
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	assert(t, "Shared factor included once", 2, len(u.Factors()))
+	assert(t, "Included factor", true, u.FindFactor("location") != nil)
+
+	os.WriteFile(filepath.Join(dir, "rooms", "office.plot"), []byte("factor location : (Hall, Office)\n"+
+		"transition t : (moon = full, choice : \"x\", location -> Hall)\n"), 0644)
+	_, err = parser.ParseFile(filepath.Join(dir, "story.plot"))
+	if errs, ok := err.(parser.ErrorList); assert(t, "Error in included file", true, ok) {
+		assert(t, "Included file named", filepath.Join(dir, "rooms", "office.plot"), errs[0].Pos.Filename)
+		assert(t, "Included file line", 2, errs[0].Pos.Line)
+		assert(t, "Included file source", "transition t : (moon = full, choice : \"x\", location -> Hall)", errs[0].Source)
+	}
+
+	os.WriteFile(filepath.Join(dir, "common.plot"), []byte("include \"story.plot\"\n"), 0644)
+	_, err = parser.ParseFile(filepath.Join(dir, "story.plot"))
+	if errs, ok := err.(parser.ErrorList); assert(t, "Cycle found", true, ok) {
+		assert(t, "Cycle position", filepath.Join(dir, "common.plot")+":1:1", errs[0].Pos.String())
+		assert(t, "Cycle message", true, strings.HasPrefix(errs[0].Msg, "include cycle: "))
+	}
+
+	_, err = parser.ParseString("include \"no-such-file\"\n", filepath.Join(dir, "story"))
+	if errs, ok := err.(parser.ErrorList); assert(t, "Missing include", true, ok) {
+		assert(t, "Missing include line", 1, errs[0].Pos.Line)
+	}
+}
+
+func Test_ParseIncludeWordAsName(t *testing.T) {
+	u, err := parser.ParseString("factor include : (yes, include)\n"+
+		"transition include : (include = yes, choice : \"Include it.\", include -> include)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	assert(t, "Factor named include", true, u.FindFactor("include").Possible("include"))
+	assert(t, "Transition named include", "include", u.Transitions()[0].Label())
+}
+
+func Test_ParseMissingFile(t *testing.T) {
+	_, err := parser.ParseFile("no-such-file")
+	assert(t, "Open error", true, os.IsNotExist(err))
+}
+
+func Test_ParseConcurrent(t *testing.T) {
+	good := "factor sun : (day, night)\n"
+	bad := "factor sun : (day night)\n"
+
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			src := good
+			if i%2 == 1 {
+				src = bad
+			}
+			_, errs[i] = parser.NewParser(strings.NewReader(src), "story").Parse()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		assert(t, "Parse "+string(rune('a'+i)), i%2 == 1, err != nil)
+	}
+}
+
+func Test_ParseString(t *testing.T) {
+	u, err := parser.ParseString("factor sun : (day, night)", "inline")
+	assert(t, "No errors", nil, err)
+	if assert(t, "Universe built", true, u != nil) {
+		assert(t, "Factor found", true, u.FindFactor("sun") != nil)
+	}
+
+	_, err = parser.ParseString("factor sun (day, night)", "inline")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Error list", true, ok) {
+		assert(t, "Error names source", "inline", errs[0].Pos.Filename)
+	}
+}
+
+func Test_ParseFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"stories/sun.plot": {Data: []byte("factor sun : (day, night)\n")},
+	}
+	u, err := parser.ParseFS(fsys, "stories/sun.plot")
+	assert(t, "No errors", nil, err)
+	assert(t, "Universe built", true, u != nil)
+
+	fsys["stories/all.plot"] = &fstest.MapFile{Data: []byte("include \"sun.plot\"\n")}
+	u, err = parser.ParseFS(fsys, "stories/all.plot")
+	if assert(t, "Include from FS", nil, err) {
+		assert(t, "Included from FS", true, u.FindFactor("sun") != nil)
+	}
+
+	_, err = parser.ParseFS(fsys, "stories/moon.plot")
+	assert(t, "Missing file", true, err != nil)
+}
+
+func Test_ParseValidates(t *testing.T) {
+	_, err := parser.ParseString("factor sun : (day, night)\n"+
+		"transition t : (moon = full, choice : \"x\", sun -> day)\n", "story")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Unknown factor reported", true, ok) {
+		assert(t, "Unknown factor position", 2, errs[0].Pos.Line)
+		assert(t, "Unknown factor found", "name \"moon\"", errs[0].Found)
+	}
+
+	u, err := parser.ParseString("factor sun : (day, night)\n"+
+		"transition t : (sun = day, choice : \"x\", sun -> noon)\n", "story")
+	assert(t, "Unknown value fails", true, u == nil)
+	if verrs, ok := err.(state.ValidationErrors); assert(t, "Unknown value reported", true, ok) {
+		assert(t, "Validation error position", "story:2:1", verrs[0].Pos)
+	}
+
+	p := parser.NewParser(strings.NewReader("factor sun : (day, night)\n"+
+		"transition t : (sun = day, choice : \"x\", sun -> noon)\n"), "story")
+	p.NoValidate = true
+	u, err = p.Parse()
+	assert(t, "Validation skipped", nil, err)
+
+	u, err = parser.ParseString("factor sun : (day, night)\n"+
+		"transition t : (sun = day, choice : \"x\", sun -> day, \"Nothing happens.\")\n", "story")
+	assert(t, "Warnings keep universe", true, u != nil)
+	assert(t, "Warnings reported", true, err != nil)
+}
+
+func Test_ParseTimed(t *testing.T) {
+	u, err := parser.ParseString("factor guard : (here, gone)\n"+
+		"transition back : (guard = gone, after 5, guard -> here)\n"+
+		"transition patrol : (guard = here, every 3, guard -> gone)\n"+
+		"transition start : (guard = here, at turn 0, guard -> gone)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		return
+	}
+	ts := u.Transitions()
+	assert(t, "After", state.After{Turns: 5}, ts[0].Schedule())
+	assert(t, "Every", state.Every{Turns: 3}, ts[1].Schedule())
+	assert(t, "At turn", state.AtTurn{Turn: 0}, ts[2].Schedule())
+
+	_, err = parser.ParseString("factor guard : (here, gone)\n"+
+		"transition back : (guard = gone, at 5, guard -> here)\n", "story")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Missing 'turn'", true, ok) {
+		assert(t, "Expected 'turn'", "'turn'", errs[0].Expected)
+	}
+
+	_, err = parser.ParseString("factor guard : (here, gone)\n"+
+		"transition back : (guard = gone, after 0, guard -> here)\n", "story")
+	assert(t, "Zero turns rejected", true, err != nil)
+}
+
+func Test_ParseScheduleWordsAsNames(t *testing.T) {
+	u, err := parser.ParseString("factor turn : (0:100)\n"+
+		"factor time : (before, after)\n"+
+		"factor at : (every, home)\n"+
+		"transition every : (time = before & at = home, after 2, (time -> after, turn + 1))\n"+
+		"transition tick : (time = after, at turn 3, at -> every)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	assert(t, "Factor named turn", true, u.FindFactor("turn") != nil)
+	assert(t, "Value named after", true, u.FindFactor("time").Possible("after"))
+	ts := u.Transitions()
+	assert(t, "Transition named every", "every", ts[0].Label())
+	assert(t, "Schedule still read", state.After{Turns: 2}, ts[0].Schedule())
+	assert(t, "At turn still read", state.AtTurn{Turn: 3}, ts[1].Schedule())
+}
+
+func Test_ParseOutcomes(t *testing.T) {
+	u, err := parser.ParseString("factor door : (shut, open, stuck)\n"+
+		"factor tries : (0:3)\n"+
+		"transition try : (door = shut, choice : \"Try the door.\", outcomes :\n"+
+		"    0.7 -> (door -> open, \"It opens.\"),\n"+
+		"    0.3 -> (door -> stuck, tries + 1),\n"+
+		"    1 -> (\"Nothing happens.\"))\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	outs := u.Transitions()[0].Outcomes()
+	if assert(t, "Outcomes", 3, len(outs)) {
+		assert(t, "Weight", 0.7, outs[0].Weight())
+		assert(t, "Text", "It opens.", outs[0].Description())
+		assert(t, "Whole number weight", 1.0, outs[2].Weight())
+		assert(t, "Text only", "Nothing happens.", outs[2].Description())
+	}
+
+	// outcomes is only a keyword when it's followed by a ':'
+	u, err = parser.ParseString("factor outcomes : (none, some)\n"+
+		"factor luck : (outcomes, bad)\n"+
+		"transition a : (outcomes = none, choice : \"A.\", outcomes -> some, \"Some.\")\n"+
+		"transition b : (luck = bad, choice : \"B.\", (outcomes -> none, luck -> outcomes))\n"+
+		"transition c : (luck = bad, choice : \"C.\", outcomes : 1 -> (outcomes -> some))\n", "story")
+	if assert(t, "Outcomes as a name", nil, err) {
+		ts := u.Transitions()
+		s := u.Instantiate()
+		ts[0].Apply(s)
+		assert(t, "Effect on outcomes", state.Value("some"), s.Get(u.FindFactor("outcomes")))
+		assert(t, "No outcomes", 0, len(ts[0].Outcomes()))
+		assert(t, "Outcomes keyword", 1, len(ts[2].Outcomes()))
+	}
+
+	_, err = parser.ParseString("factor door : (shut, open)\n"+
+		"transition try : (door = shut, choice : \"Try.\", outcomes : 0 -> (door -> open))\n", "story")
+	assert(t, "Zero weight rejected", true, err != nil)
+
+	_, err = parser.ParseString("factor door : (shut, open)\n"+
+		"transition try : (door = shut, choice : \"Try.\", outcomes : 1 -> ())\n", "story")
+	assert(t, "Empty outcome rejected", true, err != nil)
+}
+
+func Test_ParseExclusive(t *testing.T) {
+	u, err := parser.ParseString("option settle\n"+
+		"factor phone : (quiet, ringing)\n"+
+		"exclusive jeanna : (ring, hangup)\n"+
+		"transition ring : (phone = quiet, spontaneous 0.5 priority 2, phone -> ringing)\n"+
+		"transition hangup : (phone = ringing, spontaneous 0.5, phone -> quiet)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	assert(t, "Settles", true, u.Settles())
+	assert(t, "Priority", 2, u.Transitions()[0].Priority())
+	if gs := u.Exclusives(); assert(t, "Exclusive groups", 1, len(gs)) {
+		assert(t, "Group label", "jeanna", gs[0].Label())
+		assert(t, "Group declared before its transitions", 2, len(gs[0].Transitions()))
+	}
+
+	_, err = parser.ParseString("factor phone : (quiet, ringing)\n"+
+		"exclusive : (ring, hangup)\n"+
+		"transition ring : (phone = quiet, spontaneous 0.5, phone -> ringing)\n", "story")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Unknown transition reported", true, ok) {
+		assert(t, "Unknown transition position", parser.Position{Filename: "story", Line: 2, Column: 20}, errs[0].Pos)
+		assert(t, "Unknown transition found", "name \"hangup\"", errs[0].Found)
+	}
+
+	_, err = parser.ParseString("option fast\n", "story")
+	assert(t, "Unknown option", true, err != nil)
+}
+
+func Test_ParseExclusiveWordsAsNames(t *testing.T) {
+	u, err := parser.ParseString("factor option : (a, b)\n"+
+		"factor priority : (exclusive, option)\n"+
+		"transition exclusive : (option = a, spontaneous 1 priority 3, (option -> b, priority -> option))\n"+
+		"transition option : (option = b, spontaneous 1, option -> a)\n"+
+		"exclusive priority : (exclusive, option)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	assert(t, "Factor named option", true, u.FindFactor("option") != nil)
+	assert(t, "Value named exclusive", true, u.FindFactor("priority").Possible("exclusive"))
+	assert(t, "Transition named exclusive", "exclusive", u.Transitions()[0].Label())
+	assert(t, "Priority still read", 3, u.Transitions()[0].Priority())
+	assert(t, "Group named priority", "priority", u.Exclusives()[0].Label())
+
+	// After a mistake, the next line starting with option is a declaration
+	_, err = parser.ParseString("factor a (x, option)\n"+
+		"option settle\n"+
+		"factor b : x\n", "story")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Errors", true, ok) {
+		assert(t, "Both mistakes reported", 2, len(errs))
+		assert(t, "Option read", 3, errs[len(errs)-1].Pos.Line)
+	}
+}
+
+func Test_ParseDescription(t *testing.T) {
+	u, err := parser.ParseString("factor sun : (day, night)\n"+
+		"description : (sun = night, \"It is dark.\")\n", "story")
+	assert(t, "No errors", nil, err)
+	s := u.Instantiate()
+	assert(t, "Not described by day", 0, len(s.Descriptions()))
+
+	u, err = parser.ParseString("factor sun : (night, day)\n"+
+		"description : (sun = night, \"It is dark.\")\n", "story")
+	s = u.Instantiate()
+	if ds := s.Descriptions(); assert(t, "Described by night", 1, len(ds)) {
+		assert(t, "Description text", "It is dark.", ds[0])
+	}
+}
+
+func Test_ParseEnding(t *testing.T) {
+	u, err := parser.ParseString("factor door : (shut, open)\n"+
+		"transition open : (door = shut, choice : \"Open the door.\", door -> open)\n"+
+		"ending escaped : (door = open, \"You escape.\")\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	if es := u.Endings(); assert(t, "Endings", 1, len(es)) {
+		assert(t, "Ending label", "escaped", es[0].Label())
+		assert(t, "Ending text", "You escape.", es[0].Text())
+	}
+	s := u.Instantiate()
+	assert(t, "Not ended", false, s.Ended())
+	s.ChosenTransitions()[0].Apply(s)
+	assert(t, "Ended", true, s.Ended())
+}
+
+func Test_ParseEndingWordAsName(t *testing.T) {
+	u, err := parser.ParseString("factor ending : (happy, ending)\n"+
+		"transition ending : (ending = happy, choice : \"End it.\", ending -> ending)\n"+
+		"ending ending : (ending = ending, \"The end.\")\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	assert(t, "Factor named ending", true, u.FindFactor("ending") != nil)
+	assert(t, "Transition named ending", "ending", u.Transitions()[0].Label())
+	if es := u.Endings(); assert(t, "Endings", 1, len(es)) {
+		assert(t, "Ending named ending", "ending", es[0].Label())
+	}
+}
+
+func Test_ParseCondition(t *testing.T) {
+	u, _ := parser.ParseString("factor door : (shut, open)\nfactor keys : (0:3)\n", "story")
+	e, err := parser.ParseCondition(u, "door = shut & keys < 2")
+	if assert(t, "No errors", nil, err) {
+		assert(t, "Holds", true, e.Evaluate(u.Instantiate()))
+	}
+	_, err = parser.ParseCondition(u, "window = open")
+	assert(t, "Unknown factor", true, err != nil)
+	_, err = parser.ParseCondition(u, "door = shut )")
+	if assert(t, "Trailing text", true, err != nil) {
+		assert(t, "Trailing text error", "condition:1:13: expected end of condition, found ')'\n\tdoor = shut )\n\t            ^", err.Error())
+	}
+}
+
+func Test_ParseText(t *testing.T) {
+	u, err := parser.ParseString("factor lieu : (salle, café)\r\n"+
+		"\tdescription : (lieu = café, \"Il dit \\\"bonjour\\\".\\nC:\\\\\")\r\n"+
+		"ending fin : (lieu = salle, \"\"\"\n"+
+		"    Première ligne.\n"+
+		"      Deuxième, en retrait.\n"+
+		"    \"\"\")\n", "histoire")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	s := u.Instantiate()
+	assert(t, "UTF-8 value", state.Value("salle"), s.Get(u.FindFactor("lieu")))
+	assert(t, "Triple-quoted text", "Première ligne.\n  Deuxième, en retrait.", u.Endings()[0].Text())
+	s, _ = u.InstantiateWith(map[string]string{"lieu": "café"})
+	if ds := s.Descriptions(); assert(t, "Described", 1, len(ds)) {
+		assert(t, "Escapes", "Il dit \"bonjour\".\nC:\\", ds[0])
+	}
+
+	_, err = parser.ParseString("factor été (oui, non)\n", "histoire")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Error after UTF-8", true, ok) {
+		assert(t, "Column counts characters", 12, errs[0].Pos.Column)
+	}
+
+	_, err = parser.ParseString("factor sun : (day, night)\n"+
+		"description : (sun = day, \"Bright\n", "story")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Unterminated text", true, ok) && assert(t, "One error", 1, len(errs)) {
+		assert(t, "Unterminated position", 2, errs[0].Pos.Line)
+		assert(t, "Unterminated column", 27, errs[0].Pos.Column)
+	}
+
+	_, err = parser.ParseString("description : (sun = day, \"\\q\")\n", "story")
+	assert(t, "Unknown escape", true, err != nil)
+	_, err = parser.ParseString("factor sun—moon : (day, night)\n", "story")
+	assert(t, "Punctuation in name", true, err != nil)
+}
+
+func Test_ParseTemplate(t *testing.T) {
+	u, err := parser.ParseString("factor sun : (day, night)\n"+
+		"factor gold : (0:9) = 3\n"+
+		"transition set : (sun = day, choice : \"Wait for {if gold > 2}rich {/if}night.\", sun -> night, \"It is {sun}.\")\n"+
+		"description : (sun = night, \"{if sun = night}Dark{else}Bright{/if}, {gold} gold, {{braces}.\")\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	s := u.Instantiate()
+	tr := s.ChosenTransitions()[0]
+	assert(t, "Choice", "Wait for rich night.", tr.Choice(s))
+	tr.Apply(s)
+	assert(t, "Description at the moment it happened", "It is night.", s.Now().Description())
+	if ds := s.Descriptions(); assert(t, "Described", 1, len(ds)) {
+		assert(t, "Conditional text", "Dark, 3 gold, {braces}.", ds[0])
+	}
+
+	for _, bad := range []string{"{sun", "{if sun = day}x", "x{/if}", "{else}", "{if sun = }x{/if}", "{two words}"} {
+		_, err = parser.ParseString("factor sun : (day, night)\n"+
+			"description : (sun = day, \""+bad+"\")\n", "story")
+		if errs, ok := err.(parser.ErrorList); assert(t, "Bad template "+bad, true, ok) {
+			assert(t, "Bad template position "+bad, "story:2:27", errs[0].Pos.String())
+		}
+	}
+	_, err = parser.ParseString("factor sun : (day, night)\n"+
+		"description : (sun = day, \"{moon} {if tide = high}x{/if}\")\n", "story")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Undeclared factors in template", true, ok) && assert(t, "Both found", 2, len(errs)) {
+		assert(t, "Undeclared factor", "name \"moon\"", errs[0].Found)
+		assert(t, "Undeclared factor position", 27, errs[1].Pos.Column)
+	}
+}
+
+func Test_ParseNumeric(t *testing.T) {
+	u, err := parser.ParseString("factor health : (0:10)\n"+
+		"factor temp : (-5:5)\n"+
+		"transition hurt : (health > 0, choice : \"Fall.\", (health - 3, temp -> -2))\n"+
+		"transition heal : (health <= 9 & temp < 0, choice : \"Rest.\", health + 1)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	health, temp := u.FindFactor("health"), u.FindFactor("temp")
+	s := u.Instantiate()
+	assert(t, "Initial health", 0, s.GetInt(health))
+	assert(t, "Initial temp", -5, s.GetInt(temp))
+	if ts := s.ChosenTransitions(); assert(t, "Only heal", 1, len(ts)) {
+		ts[0].Apply(s)
+	}
+	assert(t, "Healed", 1, s.GetInt(health))
+	if ts := s.ChosenTransitions(); assert(t, "Both choices", 2, len(ts)) {
+		for _, tr := range ts {
+			if tr.ChoiceDescription() == "Fall." {
+				tr.Apply(s)
+			}
+		}
+	}
+	assert(t, "Hurt, clamped", 0, s.GetInt(health))
+	assert(t, "Temp set", -2, s.GetInt(temp))
+}
+
+func Test_ParseNegation(t *testing.T) {
+	u, err := parser.ParseString("factor loc : (Hall, Office, Lab)\n"+
+		"transition a : (loc != Office, choice : \"A\", loc -> Office)\n"+
+		"transition b : (not loc = Hall & loc in (Hall, Lab), choice : \"B\", loc -> Hall)\n"+
+		"transition c : (loc not in (Office, Lab), choice : \"C\", loc -> Lab)\n"+
+		"transition d : (loc = Office, choice : \"D\", loc -> Lab)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	s := u.Instantiate()
+	choices := func() map[string]*state.Transition {
+		m := map[string]*state.Transition{}
+		for _, tr := range s.ChosenTransitions() {
+			m[tr.ChoiceDescription()] = tr
+		}
+		return m
+	}
+
+	cs := choices()
+	assert(t, "Hall choices", 2, len(cs))
+	assert(t, "Hall != Office", true, cs["A"] != nil)
+	assert(t, "Hall not in (Office, Lab)", true, cs["C"] != nil)
+	cs["A"].Apply(s)
+
+	cs = choices()
+	assert(t, "Office choices", 1, len(cs))
+	cs["D"].Apply(s)
+
+	cs = choices()
+	assert(t, "Lab choices", 2, len(cs))
+	assert(t, "not Lab = Hall & Lab in (Hall, Lab)", true, cs["B"] != nil)
+}
+
+func Test_ParseNegationWordsAsNames(t *testing.T) {
+	u, err := parser.ParseString("factor position : (out, in)\n"+
+		"factor not : (in, out)\n"+
+		"transition in : (position = out & not = in, choice : \"In\", position -> in)\n"+
+		"transition out : (not != out & position in (in) & not position not in (in), choice : \"Out\", position -> out)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	assert(t, "Value named in", true, u.FindFactor("position").Possible("in"))
+	assert(t, "Factor named not", true, u.FindFactor("not") != nil)
+	assert(t, "Transition named in", "in", u.Transitions()[0].Label())
+	s := u.Instantiate()
+	assert(t, "Conditions still read", "In", s.ChosenTransitions()[0].ChoiceDescription())
+	s.ChosenTransitions()[0].Apply(s)
+	assert(t, "Negation still read", "Out", s.ChosenTransitions()[0].ChoiceDescription())
+}
+
+func Test_ParseInitial(t *testing.T) {
+	u, err := parser.ParseString("factor sun : (day, night) = night\n"+
+		"factor loc : (Hall, Lab) initial Lab\n"+
+		"factor gold : (0:100) = 50\n"+
+		"factor moon : (full, new)\n", "story")
+	if !assert(t, "No errors", nil, err) {
+		t.Log(err)
+		return
+	}
+	s := u.Instantiate()
+	assert(t, "Explicit initial", state.Value("night"), s.Get(u.FindFactor("sun")))
+	assert(t, "initial keyword", state.Value("Lab"), s.Get(u.FindFactor("loc")))
+	assert(t, "Numeric initial", 50, s.GetInt(u.FindFactor("gold")))
+	assert(t, "Default initial", state.Value("full"), s.Get(u.FindFactor("moon")))
+
+	_, err = parser.ParseString("factor sun : (day, night) = noon\n"+
+		"factor gold : (0:100) = 500\n", "story")
+	if errs, ok := err.(parser.ErrorList); assert(t, "Bad initial values", true, ok) && assert(t, "Error count", 2, len(errs)) {
+		assert(t, "Error position", 29, errs[0].Pos.Column)
+		assert(t, "Error found", "noon", errs[0].Found)
+	}
 }
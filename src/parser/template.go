@@ -0,0 +1,167 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Templates in text: {factor} for a factor's value, and
+	{if CONDITION}...{else}...{/if} for text that depends on a condition.
+	{{ stands for a {.
+*/
+
+package parser
+
+import (
+	"ast"
+	"strings"
+	"unicode"
+)
+
+// Quoted text, which can have template parts in it.
+func (p *Parser) Text() *ast.Text {
+	pos := p.current_pos
+	raw := p.current_string
+	p.Match(STRING_LITERAL)
+	return &ast.Text{Pos: ast.Pos{Line: pos.Line, Column: pos.Column}, Raw: raw, Parts: p.template(raw, pos)}
+}
+
+// Splits text into its template parts.  Problems are reported at pos, where
+// the text starts, as escapes and line breaks mean that the text doesn't
+// line up with the source.
+func (p *Parser) template(text string, pos Position) []ast.TextPart {
+	problem := func(msg string) {
+		p.errors = append(p.errors, &Error{Pos: pos, Msg: msg})
+	}
+
+	// The {if}s we're inside, and whether we've got to their {else}s
+	var parts []ast.TextPart
+	var ifs []*ast.If
+	var inElse []bool
+	add := func(part ast.TextPart) {
+		if len(ifs) == 0 {
+			parts = append(parts, part)
+		} else if i := ifs[len(ifs)-1]; inElse[len(ifs)-1] {
+			i.Else = append(i.Else, part)
+		} else {
+			i.Then = append(i.Then, part)
+		}
+	}
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			add(&ast.Literal{Text: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for len(text) > 0 {
+		if strings.HasPrefix(text, "{{") {
+			literal.WriteByte('{')
+			text = text[2:]
+			continue
+		} else if text[0] != '{' {
+			literal.WriteByte(text[0])
+			text = text[1:]
+			continue
+		}
+
+		end := strings.IndexByte(text, '}')
+		if end < 0 {
+			problem("text has a { with no } to close it; write {{ for a {")
+			break
+		}
+		tag := strings.TrimSpace(text[1:end])
+		text = text[end+1:]
+		flush()
+		words := strings.Fields(tag)
+		switch {
+		case tag == "else":
+			if len(ifs) == 0 || inElse[len(ifs)-1] {
+				problem("text has an {else} without an {if} before it")
+			} else {
+				inElse[len(ifs)-1] = true
+			}
+		case tag == "/if":
+			if len(ifs) == 0 {
+				problem("text has an {/if} without an {if} before it")
+			} else {
+				ifs, inElse = ifs[:len(ifs)-1], inElse[:len(inElse)-1]
+			}
+		case len(words) > 0 && words[0] == "if":
+			i := &ast.If{Condition: p.templateCondition(strings.TrimSpace(tag[2:]), pos)}
+			add(i)
+			ifs, inElse = append(ifs, i), append(inElse, false)
+		case isName(tag):
+			add(&ast.Value{Factor: tag})
+		default:
+			problem("text has {" + tag + "} in it, which isn't a factor name, if, else or /if")
+		}
+	}
+	flush()
+	if len(ifs) > 0 {
+		problem("text has an {if} without an {/if} to end it")
+	}
+	return parts
+}
+
+// Reads the condition of an {if}, reporting any problems with it at pos.
+func (p *Parser) templateCondition(src string, pos Position) ast.Expr {
+	sub := NewParser(strings.NewReader(src), p.filename)
+	e := sub.condition()
+	for _, err := range sub.errors {
+		err.Pos = pos
+		p.errors = append(p.errors, err)
+	}
+	if e != nil {
+		placeAt(e, ast.Pos{Line: pos.Line, Column: pos.Column})
+	}
+	return e
+}
+
+// Moves everything in e to pos, so that compile errors in an {if} point to
+// the text it's in.
+func placeAt(e ast.Expr, pos ast.Pos) {
+	switch e := e.(type) {
+	case *ast.And:
+		for _, c := range e.Clauses {
+			placeAt(c, pos)
+		}
+	case *ast.Or:
+		for _, c := range e.Clauses {
+			placeAt(c, pos)
+		}
+	case *ast.Not:
+		e.Pos = pos
+		placeAt(e.Clause, pos)
+	case *ast.Paren:
+		e.Pos = pos
+		placeAt(e.X, pos)
+	case *ast.Compare:
+		e.Pos = pos
+	case *ast.In:
+		e.Pos = pos
+	}
+}
+
+func isName(s string) bool {
+	for _, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,107 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+*/
+
+package main
+
+import (
+	"analysis"
+	"flag"
+	"fmt"
+	"os"
+	"parser"
+	"state"
+	"strings"
+)
+
+// Looks for mistakes in stories: everything the parser finds, and then, by
+// exploring every state each story can get into, transitions that can never
+// happen, values that factors never have, endings that can't be reached and
+// places the player can get stuck.
+func checkCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() { commandUsage(flags) }
+	limit := flags.Int("limit", analysis.DefaultLimit, "explore at most `n` states of each story")
+	strict := flags.Bool("strict", false, "fail on warnings as well as errors")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, name := range flags.Args() {
+		u, err := parser.ParseFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			if u == nil || *strict {
+				status = 1
+			}
+		}
+		if u == nil {
+			continue
+		}
+		warnings := explore(u, *limit)
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s\n", name, w)
+		}
+		if len(warnings) > 0 && *strict {
+			status = 1
+		}
+	}
+	return status
+}
+
+// The problems found by exploring u.
+func explore(u *state.Universe, limit int) []string {
+	var warnings []string
+	g := analysis.Explore(u, limit)
+	if g.Truncated {
+		warnings = append(warnings, fmt.Sprintf("stopped after %d states, so some of these might be wrong", len(g.Nodes)))
+	}
+	for _, t := range g.UnreachableTransitions() {
+		warnings = append(warnings, "transition "+t.Label()+": can never happen")
+	}
+	unreached := g.UnreachableValues()
+	for _, f := range u.Factors() {
+		for _, v := range unreached[f] {
+			warnings = append(warnings, "factor "+f.Label()+": never has value "+string(v))
+		}
+	}
+	for _, e := range g.UnreachableEndings() {
+		warnings = append(warnings, "ending "+e.Label()+": can never be reached")
+	}
+	for _, n := range g.DeadEnds() {
+		var here []state.BoolExpr
+		for f, v := range n.Values {
+			here = append(here, state.FactorEquals{Factor: f, Value: v})
+		}
+		var steps []string
+		path, _ := g.ShortestPath(state.MkAnd(here...))
+		for _, t := range path {
+			steps = append(steps, t.Label())
+		}
+		stuck := "stuck with nothing to do at " + n.String()
+		if len(steps) > 0 {
+			stuck += ", after " + strings.Join(steps, ", ")
+		}
+		warnings = append(warnings, stuck)
+	}
+	return warnings
+}
@@ -0,0 +1,40 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Writes a story as JSON, for other programs to read.
+func exportCommand(args []string) int {
+	flags := newStoryFlags("export", false)
+	u := flags.Story(args)
+	if u == nil {
+		return 1
+	}
+	if err := u.Export(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"format"
+	"os"
+	"strings"
+)
+
+// Reformats each story named, printing the result unless told otherwise.
+func fmtCommand(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	flags.Usage = func() { commandUsage(flags) }
+	diff := flags.Bool("d", false, "print a diff of the changes instead of the stories")
+	write := flags.Bool("w", false, "write the stories back to their files")
+	list := flags.Bool("l", false, "list the stories that would change")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, name := range flags.Args() {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		out, err := format.Source(src, name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		changed := !bytes.Equal(src, out)
+		if *list && changed {
+			fmt.Println(name)
+		}
+		if *write && changed {
+			if err := os.WriteFile(name, out, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				status = 1
+			}
+		}
+		if *diff && changed {
+			fmt.Print(unifiedDiff(name, string(src), string(out)))
+		}
+		if !*list && !*write && !*diff {
+			os.Stdout.Write(out)
+		}
+	}
+	return status
+}
+
+// How many unchanged lines to show around each change.
+const diffContext = 3
+
+// A diff of two versions of a file, in the unified format that diff -u and
+// patch use.
+func unifiedDiff(name string, a string, b string) string {
+	as, bs := diffLines(a), diffLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of as[i:]
+	// and bs[j:]
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Each line of the diff, marked ' ', '-' or '+'
+	type line struct {
+		mark byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && j < len(bs) && as[i] == bs[j]:
+			lines = append(lines, line{' ', as[i]})
+			i++
+			j++
+		case j == len(bs) || i < len(as) && lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, line{'-', as[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', bs[j]})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", name, name)
+	aLine, bLine := 1, 1
+	for k := 0; k < len(lines); {
+		if lines[k].mark == ' ' {
+			aLine++
+			bLine++
+			k++
+			continue
+		}
+		// A hunk runs from a change until there are more than twice the
+		// context lines without one
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for unchanged := 0; end < len(lines) && unchanged <= 2*diffContext; end++ {
+			if lines[end].mark == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > k && lines[end-1].mark == ' ' {
+			end--
+		}
+		if end+diffContext < len(lines) {
+			end += diffContext
+		} else {
+			end = len(lines)
+		}
+
+		aStart, bStart := aLine-(k-start), bLine-(k-start)
+		aCount, bCount := 0, 0
+		for _, l := range lines[start:end] {
+			if l.mark != '+' {
+				aCount++
+			}
+			if l.mark != '-' {
+				bCount++
+			}
+		}
+		aLine, bLine = aStart+aCount, bStart+bCount
+		// An empty range is numbered from the line before it
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, l := range lines[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", l.mark, l.text)
+		}
+		k = end
+	}
+	return out.String()
+}
+
+func diffLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
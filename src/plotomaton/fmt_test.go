@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The numbers from from to to, one per line.
+func numbered(from, to int) string {
+	var lines []string
+	for i := from; i <= to; i++ {
+		lines = append(lines, strconv.Itoa(i))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func Test_UnifiedDiff(t *testing.T) {
+	for _, c := range []struct {
+		name, a, b, want string
+	}{
+		{"Identical", "a\nb\n", "a\nb\n", ""},
+		{"Insertion only", "a\nb\n", "a\nx\nb\n",
+			"@@ -1,2 +1,3 @@\n a\n+x\n b\n"},
+		{"Deletion only", "a\nx\nb\n", "a\nb\n",
+			"@@ -1,3 +1,2 @@\n a\n-x\n b\n"},
+		{"From nothing", "", "a\n",
+			"@@ -0,0 +1,1 @@\n+a\n"},
+		{"To nothing", "a\n", "",
+			"@@ -1,1 +0,0 @@\n-a\n"},
+		{"Mixed hunks", numbered(1, 12), "one\n" + numbered(2, 13),
+			"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n"},
+		{"Nearby changes share a hunk", numbered(1, 8), "one\n" + numbered(2, 7) + "eight\n",
+			"@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n"},
+	} {
+		want := "--- story\n+++ story\n" + c.want
+		if got := unifiedDiff("story", c.a, c.b); got != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", c.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+*/
+
+package main
+
+import (
+	"analysis"
+	"fmt"
+	"os"
+)
+
+// Writes a story's graph in Graphviz DOT format, e.g.
+//
+//	plotomaton graph story | dot -Tsvg > story.svg
+func graphCommand(args []string) int {
+	flags := newStoryFlags("graph", false)
+	states := flags.Bool("states", false, "draw every reachable state instead of each factor's values")
+	limit := flags.Int("limit", 1000, "draw at most `n` states with --states")
+	u := flags.Story(args)
+	if u == nil {
+		return 1
+	}
+
+	var err error
+	if *states {
+		g := analysis.Explore(u, *limit)
+		if g.Truncated {
+			fmt.Fprintf(os.Stderr, "warning: stopped after %d states\n", len(g.Nodes))
+		}
+		err = g.WriteDot(os.Stdout)
+	} else {
+		err = u.WriteDot(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,253 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+	Now that that's out of the way:
+	Original Author - Samuel Payson
+	Since updated, and currently maintained, by Sean Anderson
+	Contact: fnordit@gmail.com
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"state"
+	"strconv"
+	"strings"
+)
+
+const debug bool = false
+
+// Plays a story, asking the player what to do, or following a script.
+func playCommand(args []string) int {
+	flags := newStoryFlags("play", true)
+	load := flags.String("load", "", "carry on with a game saved in `file`")
+	script := flags.String("script", "", "play the choices listed in `file` and print what happens, instead of asking")
+	u := flags.Story(args)
+	if u == nil {
+		return 1
+	}
+	input := flags.Arg(0)
+
+	// Scripts always use the same seed unless given one, so that they
+	// play out the same way every time
+	if *script == "" {
+		flags.PickSeed()
+	}
+	if *script == "" {
+		fmt.Printf("Running: %s (seed %d)\n", input, flags.Seed)
+	}
+
+	var s *state.State
+	var r *state.RNG
+	var err error
+	if *load != "" {
+		s, r, err = state.LoadFile(u, *load)
+	} else {
+		s, r, err = flags.Play(u)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	// A new game is reported from the beginning, so that what happened in
+	// the first turn is shown
+	log := s.Now()
+	if *load == "" {
+		log = s.Beginning()
+	}
+
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err == nil {
+			err = runScript(s, r, log, f, os.Stdout)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *script, err)
+			return 1
+		}
+		return 0
+	}
+
+	input_reader := bufio.NewScanner(os.Stdin)
+
+	for {
+		log = report(os.Stdout, s, log)
+
+		if debug {
+			p := s.PossibleTransitions()
+			fmt.Printf("[%v can %v]\n", s, p)
+		}
+
+		// Have user choose a transition, or what to do now that the story
+		// is over
+		ending := s.Ending()
+		choices := s.ChosenTransitions()
+		last := len(choices) + 1
+		fmt.Fprintf(os.Stdout, "  0. Exit.\n")
+		if ending != nil {
+			fmt.Fprintf(os.Stderr, "  1. Start again.\n")
+			last = 1
+			if s.Now().LastChoice() != nil {
+				fmt.Fprintf(os.Stderr, "  2. Undo.\n")
+				last = 2
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "  1. Do nothing.\n")
+		}
+		for i, t := range choices {
+			fmt.Fprintf(os.Stderr, "  %d. %s\n", i+2, t.Choice(s))
+		}
+		fmt.Fprintf(os.Stderr, "  (or save FILE, load FILE, undo, label NAME, goto NAME, branches, branch N)\n")
+		var choice int
+		moved := false
+		for {
+			fmt.Fprintf(os.Stderr, "> ")
+			if !input_reader.Scan() {
+				return 0
+			}
+			line := strings.TrimSpace(input_reader.Text())
+			if strings.HasPrefix(line, "save ") {
+				if err := state.SaveFile(strings.TrimSpace(line[5:]), s, r); err != nil {
+					fmt.Printf("Couldn't save: %s\n", err)
+				} else {
+					fmt.Printf("Saved.\n")
+				}
+				continue
+			}
+			if strings.HasPrefix(line, "load ") {
+				ls, lr, err := state.LoadFile(u, strings.TrimSpace(line[5:]))
+				if err != nil {
+					fmt.Printf("Couldn't load: %s\n", err)
+					continue
+				}
+				s, r, log = ls, lr, ls.Now()
+				moved = true
+				break
+			}
+			if m, ok := historyCommand(s, line); ok {
+				if m != nil {
+					s.Goto(m)
+					log = m
+					moved = true
+					break
+				}
+				continue
+			}
+			n, err := strconv.Atoi(line)
+			if err != nil || n < 0 || n > last {
+				fmt.Printf("Please enter a number between 0 and %d.\n", last)
+			} else /* good result */ {
+				choice = n
+				break
+			}
+		}
+		if moved {
+			continue
+		}
+		if choice == 0 {
+			return 0
+		}
+		if ending != nil {
+			m := s.Beginning().EndOfTurn()
+			if choice == 2 {
+				m = s.Now().LastChoice().Past()
+			}
+			s.Goto(m)
+			log = m
+			continue
+		}
+		if choice != 1 {
+			choices[choice-2].Apply(s)
+		}
+		s.RunSpontaneous(r.Rand)
+	}
+}
+
+// Writes out what has happened since log, and then how things are now,
+// including the ending if the story is over.  Returns the Moment to report
+// from next time.
+func report(w io.Writer, s *state.State, log *state.Moment) *state.Moment {
+	for _, text := range s.Transcript(log) {
+		fmt.Fprintf(w, "%s\n", text)
+	}
+	return s.Now()
+}
+
+// Handles commands for moving around the history.  Returns the Moment to go
+// to, if any, and whether line was a history command at all.
+func historyCommand(s *state.State, line string) (*state.Moment, bool) {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return nil, false
+	}
+	arg := strings.TrimSpace(strings.TrimPrefix(line, words[0]))
+	switch words[0] {
+	case "undo":
+		m := s.Now().LastChoice()
+		if m == nil {
+			fmt.Printf("Nothing to undo.\n")
+			return nil, true
+		}
+		return m.Past(), true
+	case "label":
+		s.Now().SetLabel(arg)
+		fmt.Printf("Labelled %q.\n", arg)
+		return nil, true
+	case "goto":
+		m := s.FindLabel(arg)
+		if m == nil {
+			fmt.Printf("Nothing is labelled %q.\n", arg)
+		}
+		return m, true
+	case "branches", "branch":
+		// Branches are the other choices that have been made instead of
+		// the last one.
+		m := s.Now().LastChoice()
+		if m == nil {
+			fmt.Printf("Nothing has been chosen yet.\n")
+			return nil, true
+		}
+		branches := m.Past().Branches()
+		if words[0] == "branch" {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > len(branches) {
+				fmt.Printf("Please enter a branch between 1 and %d.\n", len(branches))
+				return nil, true
+			}
+			return branches[n-1].EndOfTurn(), true
+		}
+		for i, b := range branches {
+			what := b.Choice()
+			if b.Cause() == nil {
+				what = doNothing
+			}
+			if b.Label() != "" {
+				what += " [" + b.Label() + "]"
+			}
+			if b == m {
+				what += " (now)"
+			}
+			fmt.Printf("  %d. %s\n", i+1, what)
+		}
+		return nil, true
+	}
+	return nil, false
+}
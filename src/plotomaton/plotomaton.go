@@ -0,0 +1,99 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Everything for playing and working on stories, as subcommands:
+	plotomaton play story, plotomaton check story, and so on.
+*/
+
+package main
+
+import (
+	"cli"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A command takes the arguments after its name, and returns the exit status.
+type command struct {
+	run   func(args []string) int
+	usage string
+}
+
+var commands map[string]command
+
+// Filled in here, as the commands' own usage messages refer back to it.
+func init() {
+	commands = map[string]command{
+		"play":     {playCommand, "play [flags] story\tplay a story"},
+		"check":    {checkCommand, "check [flags] story ...\tlook for mistakes in stories"},
+		"graph":    {graphCommand, "graph [flags] story\twrite a story's graph in Graphviz DOT format"},
+		"fmt":      {fmtCommand, "fmt [flags] story ...\treformat stories"},
+		"simulate": {simulateCommand, "simulate [flags] story\tplay a story many times at random"},
+		"test":     {testCommand, "test [flags] [file or directory ...]\trun story tests"},
+		"export":   {exportCommand, "export story\twrite a story as JSON"},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: plotomaton command [arguments]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "\t%s\n", commands[name].usage)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nplotomaton command --help describes the command's flags.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "plotomaton: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(c.run(os.Args[2:]))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Flags for a command that reads a story, with the command's usage message.
+func newStoryFlags(name string, running bool) *cli.StoryFlags {
+	f := cli.NewStoryFlags(name, running)
+	f.Usage = func() { commandUsage(f.FlagSet) }
+	return f
+}
+
+func commandUsage(f *flag.FlagSet) {
+	use := strings.SplitN(commands[f.Name()].usage, "\t", 2)
+	fmt.Fprintf(os.Stderr, "usage: plotomaton %s\n", use[0])
+	f.PrintDefaults()
+}
@@ -0,0 +1,73 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Playing a story from a script, for checking that it still goes the way
+	it should.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"state"
+	"strings"
+)
+
+// What a script says to let a turn go by without choosing anything.
+const doNothing = "Do nothing."
+
+// Plays the choices listed in script, one per line, writing a transcript of
+// what happens to out.  Each choice is the label of a transition or its
+// choice text, or "Do nothing." to let a turn go by.  Blank lines and lines
+// starting with % are skipped.  Returns an error if a choice isn't available
+// when the script gets to it.
+func runScript(s *state.State, r *state.RNG, log *state.Moment, script io.Reader, out io.Writer) error {
+	log = report(out, s, log)
+	in := bufio.NewScanner(script)
+	for line := 1; in.Scan(); line++ {
+		text := strings.TrimSpace(in.Text())
+		if text == "" || strings.HasPrefix(text, "%") {
+			continue
+		}
+		fmt.Fprintf(out, "> %s\n", text)
+		if s.Ended() {
+			return fmt.Errorf("line %d: %q comes after the story has ended", line, text)
+		}
+		if text != doNothing {
+			t := s.FindChoice(text)
+			if t == nil {
+				return fmt.Errorf("line %d: %q is not one of the choices: %s", line, text, choiceList(s))
+			}
+			t.Apply(s)
+		}
+		s.RunSpontaneous(r.Rand)
+		log = report(out, s, log)
+	}
+	return in.Err()
+}
+
+func choiceList(s *state.State) string {
+	choices := []string{doNothing}
+	for _, t := range s.ChosenTransitions() {
+		choices = append(choices, t.Choice(s))
+	}
+	return strings.Join(choices, ", ")
+}
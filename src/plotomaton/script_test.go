@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"parser"
+	"strings"
+	"testing"
+)
+
+// Plays script against the example story, set up the way play --seed 1
+// --script does, returning the transcript and any error.
+func replay(t *testing.T, script string) (string, error) {
+	u, err := parser.ParseFile("../../examples/office.plot")
+	if u == nil {
+		t.Fatal(err)
+	}
+	flags := newStoryFlags("play", true)
+	flags.Parse([]string{"--seed", "1"})
+	s, r, err := flags.Play(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = runScript(s, r, s.Beginning(), strings.NewReader(script), &out)
+	return out.String(), err
+}
+
+func Test_Script(t *testing.T) {
+	out, err := replay(t, "% To the office\nLeave room.\n\nToOfficeDay\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "The sun sets.\n" +
+		"The COSI lab is full of humming servers and half-finished projects.\n" +
+		"> Leave room.\n" +
+		"You step out into the hallway.\n" +
+		"The sun rises.\n" +
+		"You are in the hallway outside the labs.\n" +
+		"> ToOfficeDay\n" +
+		"Jeanna's door is open - you walk into her office.\n" +
+		"The sun sets.\n"
+	if out != want {
+		t.Errorf("transcript:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func Test_ScriptErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, script, err string
+	}{
+		{"Unknown choice", "Leave room.\nDance.\n",
+			`line 2: "Dance." is not one of the choices: Do nothing., Go to Jeanna's office.`},
+		{"After the ending", "Leave room.\nToOfficeDay\nTalk to Jeanna.\nAsk for a COSI key.\nLeave room.\nEnter COSI.\nDo nothing.\n",
+			`line 7: "Do nothing." comes after the story has ended`},
+	} {
+		out, err := replay(t, c.script)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: got error %v, want %s", c.name, err, c.err)
+		}
+		// The transcript stops at the line that couldn't be played
+		lines := strings.Split(strings.TrimSpace(c.script), "\n")
+		if last := "> " + lines[len(lines)-1] + "\n"; !strings.HasSuffix(out, last) {
+			t.Errorf("%s: transcript doesn't end with %q:\n%s", c.name, last, out)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"state"
+)
+
+// Plays a story many times, making every choice at random, and reports how
+// often each ending is reached and how long it takes to get there.
+func simulateCommand(args []string) int {
+	flags := newStoryFlags("simulate", true)
+	runs := flags.Int("runs", 1000, "play the story `n` times")
+	turns := flags.Int("turns", 200, "give up on a game after `n` turns")
+	u := flags.Story(args)
+	if u == nil {
+		return 1
+	}
+	flags.PickSeed()
+	fmt.Printf("Simulating: %s (seed %d)\n", flags.Arg(0), flags.Seed)
+
+	r := state.NewRNG(flags.Seed)
+	reached := map[*state.Ending]int{}
+	taken := map[*state.Ending]int{}
+	unfinished := 0
+	for i := 0; i < *runs; i++ {
+		s, err := flags.Start(u)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		s.SetRand(r.Rand)
+		s.RunSpontaneous(r.Rand)
+		n := 0
+		for ; n < *turns && !s.Ended(); n++ {
+			// With nothing to choose, the player can only wait
+			if choices := s.ChosenTransitions(); len(choices) > 0 {
+				choices[r.Intn(len(choices))].Apply(s)
+			}
+			s.RunSpontaneous(r.Rand)
+		}
+		if e := s.Ending(); e != nil {
+			reached[e]++
+			taken[e] += n
+		} else {
+			unfinished++
+		}
+	}
+
+	percent := func(n int) float64 {
+		return 100 * float64(n) / float64(*runs)
+	}
+	for _, e := range u.Endings() {
+		if n := reached[e]; n > 0 {
+			fmt.Printf("ending %s: %d (%.1f%%), after %.1f turns on average\n", e.Label(), n, percent(n), float64(taken[e])/float64(n))
+		} else {
+			fmt.Printf("ending %s: never\n", e.Label())
+		}
+	}
+	fmt.Printf("no ending after %d turns: %d (%.1f%%)\n", *turns, unfinished, percent(unfinished))
+	return 0
+}
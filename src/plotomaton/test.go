@@ -0,0 +1,102 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"storytest"
+	"strings"
+)
+
+// Runs the *.plot.test files named, or found under the directories named,
+// reporting on every step.
+func testCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	flags.Usage = func() { commandUsage(flags) }
+	quiet := flags.Bool("q", false, "only report steps that fail")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && strings.HasSuffix(path, ".plot.test") {
+				files = append(files, path)
+			}
+			return err
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	passed, failed := 0, 0
+	for _, name := range files {
+		t, err := storytest.ParseFile(name)
+		var results []storytest.Result
+		if err == nil {
+			results, err = t.Run()
+		}
+		if err != nil {
+			fmt.Printf("FAIL %s\n%s\n", name, indent(err.Error()))
+			failed++
+			continue
+		}
+		for _, res := range results {
+			if res.Passed {
+				passed++
+				if !*quiet {
+					fmt.Printf("ok   %s:%d: %s\n", name, res.Step.Line, res.Step.Text)
+				}
+			} else {
+				failed++
+				fmt.Printf("FAIL %s:%d: %s\n%s\n", name, res.Step.Line, res.Step.Text, indent(res.Diff))
+			}
+		}
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func indent(s string) string {
+	return "\t" + strings.Replace(s, "\n", "\n\t", -1)
+}
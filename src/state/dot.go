@@ -0,0 +1,128 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Graphviz output, for looking at the structure of a story.
+*/
+
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Write u as a Graphviz DOT graph, with a cluster for each factor.  Values
+// are nodes, and each transition is an edge from the value its condition
+// requires to the value it sets.  Transitions whose condition doesn't pin
+// down a factor's value start from that factor's "any" node instead.  Chosen
+// transitions are drawn solid, spontaneous ones dashed.  Each of a
+// transition's outcomes gets its own edges, labelled with its chance.
+func (u *Universe) WriteDot(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "digraph story {\n")
+
+	// Only factors that transitions change from anywhere get an "any" node
+	needsAny := map[*Factor]bool{}
+	for _, t := range u.transitions {
+		pinned := map[*Factor]Value{}
+		pins(t.condition, pinned)
+		for f, _ := range t.effects {
+			if _, ok := pinned[f]; !ok && !f.numeric {
+				needsAny[f] = true
+			}
+		}
+		for _, o := range t.outcomes {
+			for f, _ := range o.effects {
+				if _, ok := pinned[f]; !ok && !f.numeric {
+					needsAny[f] = true
+				}
+			}
+		}
+	}
+
+	for i, f := range u.factorOrder {
+		fmt.Fprintf(b, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(b, "\t\tlabel=%q;\n", f.label)
+		if f.numeric {
+			fmt.Fprintf(b, "\t\t%q [label=%q];\n", dotNode(f, ""), f.label+" "+strconv.Itoa(f.min)+":"+strconv.Itoa(f.max))
+		}
+		for _, v := range f.values {
+			style := ""
+			if v == f.initial {
+				style = ", style=bold"
+			}
+			fmt.Fprintf(b, "\t\t%q [label=%q%s];\n", dotNode(f, v), string(v), style)
+		}
+		if needsAny[f] {
+			fmt.Fprintf(b, "\t\t%q [label=\"any\", shape=point];\n", dotNode(f, "*"))
+		}
+		fmt.Fprintf(b, "\t}\n")
+	}
+
+	for _, t := range u.transitions {
+		pinned := map[*Factor]Value{}
+		pins(t.condition, pinned)
+		label := t.label + "\n" + t.choiceOutline()
+		style := ""
+		if sp, ok := t.schedule.(Spontaneous); ok {
+			label, style = t.label+" ("+strconv.FormatFloat(sp.ProbabilityPerTurn, 'g', -1, 64)+")", ", style=dashed"
+		} else if !t.schedule.ask() {
+			label, style = t.label+" ("+t.schedule.ChoiceDescription()+")", ", style=dashed"
+		}
+		u.dotEdges(b, pinned, t.effects, t.deltas, fmt.Sprintf("label=%q%s", label, style))
+		for _, o := range t.outcomes {
+			chance := strconv.FormatFloat(t.Chance(o), 'g', 3, 64)
+			u.dotEdges(b, pinned, o.effects, o.deltas, fmt.Sprintf("label=%q%s", label+" ["+chance+"]", style))
+		}
+	}
+
+	fmt.Fprintf(b, "}\n")
+	return b.Flush()
+}
+
+// Writes an edge for each factor that effects and deltas change.
+func (u *Universe) dotEdges(b *bufio.Writer, pinned map[*Factor]Value, effects map[*Factor]Value, deltas map[*Factor]int, attrs string) {
+	for _, f := range u.factorOrder {
+		v, set := effects[f]
+		n, added := deltas[f]
+		if !set && !added {
+			continue
+		}
+		from := dotNode(f, "*")
+		if pv, ok := pinned[f]; ok && !f.numeric {
+			from = dotNode(f, pv)
+		}
+		switch {
+		case set && !f.numeric:
+			fmt.Fprintf(b, "\t%q -> %q [%s];\n", from, dotNode(f, v), attrs)
+		case set:
+			fmt.Fprintf(b, "\t%q -> %q [%s, headlabel=%q];\n", dotNode(f, ""), dotNode(f, ""), attrs, "= "+string(v))
+		default:
+			fmt.Fprintf(b, "\t%q -> %q [%s, headlabel=%q];\n", dotNode(f, ""), dotNode(f, ""), attrs, fmt.Sprintf("%+d", n))
+		}
+	}
+}
+
+// The DOT node name for value v of f.  Numeric factors only have the one
+// node, named with an empty value.
+func dotNode(f *Factor, v Value) string {
+	return f.label + ":" + string(v)
+}
@@ -0,0 +1,179 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Exporting stories as JSON, for other programs to read.  Conditions are
+	written out the way they would be in a story.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type exportedStory struct {
+	Factors      []exportedFactor      `json:"factors"`
+	Transitions  []exportedTransition  `json:"transitions"`
+	Descriptions []exportedDescription `json:"descriptions"`
+	Endings      []exportedEnding      `json:"endings"`
+	Exclusive    []exportedExclusive   `json:"exclusive,omitempty"`
+	Settle       bool                  `json:"settle,omitempty"`
+}
+
+type exportedFactor struct {
+	Label   string   `json:"label"`
+	Values  []string `json:"values,omitempty"`
+	Min     *int     `json:"min,omitempty"`
+	Max     *int     `json:"max,omitempty"`
+	Initial string   `json:"initial"`
+}
+
+type exportedTransition struct {
+	Label       string            `json:"label,omitempty"`
+	Condition   string            `json:"condition"`
+	Choice      string            `json:"choice,omitempty"`
+	Probability *float64          `json:"probability,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+	After       int               `json:"after,omitempty"`
+	Every       int               `json:"every,omitempty"`
+	AtTurn      *int              `json:"at_turn,omitempty"`
+	Effects     map[string]string `json:"effects,omitempty"`
+	Deltas      map[string]int    `json:"deltas,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Outcomes    []exportedOutcome `json:"outcomes,omitempty"`
+}
+
+type exportedOutcome struct {
+	Weight      float64           `json:"weight"`
+	Effects     map[string]string `json:"effects,omitempty"`
+	Deltas      map[string]int    `json:"deltas,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+type exportedExclusive struct {
+	Label       string   `json:"label,omitempty"`
+	Transitions []string `json:"transitions"`
+}
+
+type exportedDescription struct {
+	Condition string `json:"condition"`
+	Text      string `json:"text"`
+}
+
+type exportedEnding struct {
+	Label     string `json:"label"`
+	Condition string `json:"condition"`
+	Text      string `json:"text"`
+}
+
+// Write the whole of u to w as JSON.  Chosen transitions have the choice
+// text, spontaneous ones their probability, and timed ones their number of
+// turns.  Outcomes are listed with their weights.  Exclusive groups list
+// their transitions by label.
+func (u *Universe) Export(w io.Writer) error {
+	var e exportedStory
+	for _, f := range u.factorOrder {
+		ef := exportedFactor{Label: f.label, Initial: string(f.initial)}
+		if f.numeric {
+			min, max := f.min, f.max
+			ef.Min, ef.Max = &min, &max
+		} else {
+			for _, v := range f.values {
+				ef.Values = append(ef.Values, string(v))
+			}
+		}
+		e.Factors = append(e.Factors, ef)
+	}
+	for _, t := range u.transitions {
+		et := exportedTransition{
+			Label:       t.label,
+			Condition:   conditionString(t.condition),
+			Description: t.description,
+			Priority:    t.priority,
+		}
+		switch sc := t.schedule.(type) {
+		case Chosen:
+			et.Choice = sc.Description
+		case Spontaneous:
+			p := sc.ProbabilityPerTurn
+			et.Probability = &p
+		case After:
+			et.After = sc.Turns
+		case Every:
+			et.Every = sc.Turns
+		case AtTurn:
+			n := sc.Turn
+			et.AtTurn = &n
+		}
+		et.Effects, et.Deltas = exportEffects(t.effects, t.deltas)
+		for _, o := range t.outcomes {
+			eo := exportedOutcome{Weight: o.weight, Description: o.description}
+			eo.Effects, eo.Deltas = exportEffects(o.effects, o.deltas)
+			et.Outcomes = append(et.Outcomes, eo)
+		}
+		e.Transitions = append(e.Transitions, et)
+	}
+	for _, d := range u.descriptions {
+		e.Descriptions = append(e.Descriptions, exportedDescription{conditionString(d.condition), d.text})
+	}
+	for _, end := range u.endings {
+		e.Endings = append(e.Endings, exportedEnding{end.label, conditionString(end.condition), end.text})
+	}
+	for _, g := range u.exclusives {
+		eg := exportedExclusive{Label: g.label}
+		for _, t := range g.transitions {
+			eg.Transitions = append(eg.Transitions, t.label)
+		}
+		e.Exclusive = append(e.Exclusive, eg)
+	}
+	e.Settle = u.settle
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(&e)
+}
+
+// Effects and deltas by factor label, or nil if there aren't any.
+func exportEffects(effects map[*Factor]Value, deltas map[*Factor]int) (map[string]string, map[string]int) {
+	var es map[string]string
+	var ds map[string]int
+	for f, v := range effects {
+		if es == nil {
+			es = map[string]string{}
+		}
+		es[factorLabel(f)] = string(v)
+	}
+	for f, n := range deltas {
+		if ds == nil {
+			ds = map[string]int{}
+		}
+		ds[factorLabel(f)] = n
+	}
+	return es, ds
+}
+
+func conditionString(e BoolExpr) string {
+	if e == nil {
+		return ""
+	}
+	return fmt.Sprint(e)
+}
@@ -0,0 +1,110 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Transitions with uncertain results.  A Transition can have several
+	Outcomes, each with a weight; when it happens, one of them is picked at
+	random, in proportion to their weights, and its effects and description
+	are used on top of the Transition's own.
+*/
+
+package state
+
+import (
+	"math/rand"
+)
+
+// One of the ways a Transition can turn out.
+type Outcome struct {
+	weight      float64
+	description string
+	effects     map[*Factor]Value
+	deltas      map[*Factor]int
+	template    Template
+}
+
+// Give t another way to turn out, picked weight times as often as one with
+// weight 1.
+func (t *Transition) AddOutcome(weight float64, description string, effects map[*Factor]Value) *Outcome {
+	o := &Outcome{weight, description, effects, map[*Factor]int{}, nil}
+	t.outcomes = append(t.outcomes, o)
+	return o
+}
+
+// Make o add n to the numeric factor f when it happens.
+func (o *Outcome) AddDelta(f *Factor, n int) {
+	o.deltas[f] += n
+}
+
+// Has the description of an Outcome filled in from the State it leads to.
+func (o *Outcome) SetTemplate(tmpl Template) {
+	o.template = tmpl
+}
+
+// The ways t can turn out, in the order they were added, or nil if it always
+// does the same thing.
+func (t Transition) Outcomes() []*Outcome {
+	return append([]*Outcome(nil), t.outcomes...)
+}
+
+func (o Outcome) Weight() float64 {
+	return o.weight
+}
+
+func (o Outcome) Description() string {
+	return o.description
+}
+
+// How likely o is to be picked when t happens, from 0 to 1.
+func (t Transition) Chance(o *Outcome) float64 {
+	total := 0.0
+	for _, other := range t.outcomes {
+		total += other.weight
+	}
+	if total <= 0 {
+		return 0
+	}
+	return o.weight / total
+}
+
+// Picks one of t's outcomes with r, or nil if t doesn't have any.  Nothing
+// is drawn from r for a Transition without outcomes, so that adding them to
+// one part of a story doesn't change how the rest of it plays out.
+func (t *Transition) pick(r *rand.Rand) *Outcome {
+	if len(t.outcomes) == 0 {
+		return nil
+	}
+	total := 0.0
+	for _, o := range t.outcomes {
+		total += o.weight
+	}
+	x := r.Float64() * total
+	for _, o := range t.outcomes {
+		if x < o.weight {
+			return o
+		}
+		x -= o.weight
+	}
+	return t.outcomes[len(t.outcomes)-1]
+}
+
+// The Outcome of the Transition that led to m, or nil if it only had the one.
+func (m Moment) Outcome() *Outcome {
+	return m.outcome
+}
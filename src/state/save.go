@@ -0,0 +1,319 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Saving and loading games.  A saved game is JSON, holding the whole tree of
+	Moments, and refers to factors and transitions by their labels, so it
+	means the same thing to any copy of the story it was saved from.  Each
+	save records a fingerprint of the story, and Load refuses to restore a
+	game into a different story.
+*/
+
+package state
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// The version of the save format written by Save.  Load only reads games
+// saved in this version.
+const SaveVersion = 1
+
+// An RNG is a random number generator that keeps track of how far through
+// its sequence it is, so that it can be saved and restored with a game.
+type RNG struct {
+	*rand.Rand
+	src *countingSource
+}
+
+type countingSource struct {
+	seed int64
+	n    uint64
+	src  rand.Source64
+}
+
+func (c *countingSource) Int63() int64 {
+	c.n++
+	return c.src.Int63()
+}
+
+func (c *countingSource) Uint64() uint64 {
+	c.n++
+	return c.src.Uint64()
+}
+
+func (c *countingSource) Seed(seed int64) {
+	c.seed, c.n = seed, 0
+	c.src.Seed(seed)
+}
+
+func NewRNG(seed int64) *RNG {
+	src := &countingSource{seed, 0, rand.NewSource(seed).(rand.Source64)}
+	return &RNG{rand.New(src), src}
+}
+
+// Make an RNG that carries on from where one with the given seed was after
+// position numbers had been drawn from it.
+func RestoreRNG(seed int64, position uint64) *RNG {
+	r := NewRNG(seed)
+	for r.src.n < position {
+		r.src.Int63()
+	}
+	return r
+}
+
+func (r *RNG) Seed() int64 {
+	return r.src.seed
+}
+
+func (r *RNG) Position() uint64 {
+	return r.src.n
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type savedGame struct {
+	Version  int           `json:"version"`
+	Story    string        `json:"story"`
+	Seed     int64         `json:"seed"`
+	Position uint64        `json:"position"`
+	Now      int           `json:"now"`
+	History  []savedMoment `json:"history"`
+}
+
+// Moments are saved parents first, so Parent (and Future) always refer back
+// to an earlier entry in the history.  The first Moment's Parent is -1, as is
+// the Future of a Moment with no branches.  Outcomes are numbered from 1, in
+// the order they were added to their Transition.
+type savedMoment struct {
+	Parent  int               `json:"parent"`
+	Future  int               `json:"future"`
+	Label   string            `json:"label,omitempty"`
+	Cause   string            `json:"cause,omitempty"`
+	Outcome int               `json:"outcome,omitempty"`
+	Values  map[string]string `json:"values"`
+	Turn    int               `json:"turn,omitempty"`
+	Since   map[string]int    `json:"since,omitempty"`
+}
+
+// Write s, with its whole history, and rng to w.  rng may be nil if the game
+// doesn't need its random numbers restored, in which case Load will give back
+// an RNG seeded with 0.
+func Save(w io.Writer, s *State, rng *RNG) error {
+	u := s.universe
+	keys := u.transitionKeys()
+
+	g := savedGame{Version: SaveVersion, Story: u.Fingerprint()}
+	index := map[*Moment]int{nil: -1}
+	s.Beginning().walk(func(m *Moment) {
+		index[m] = len(g.History)
+		if m == s.now {
+			g.Now = len(g.History)
+		}
+		sm := savedMoment{Parent: index[m.past], Future: -1, Label: m.label, Values: map[string]string{}}
+		if m.cause != nil {
+			sm.Cause = keys[m.cause]
+			for i, o := range m.cause.outcomes {
+				if o == m.outcome {
+					sm.Outcome = i + 1
+				}
+			}
+		}
+		for f, v := range m.values {
+			sm.Values[f.label] = string(v)
+		}
+		sm.Turn = m.turn
+		for t, turn := range m.since {
+			if sm.Since == nil {
+				sm.Since = map[string]int{}
+			}
+			sm.Since[keys[t]] = turn
+		}
+		g.History = append(g.History, sm)
+	})
+	// Futures aren't numbered until after their parents are saved
+	for m, i := range index {
+		if m != nil && m.future != nil {
+			g.History[i].Future = index[m.future]
+		}
+	}
+	if rng != nil {
+		g.Seed, g.Position = rng.Seed(), rng.Position()
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&g)
+}
+
+// Save to the file with the given name, replacing anything already in it.
+func SaveFile(name string, s *State, rng *RNG) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := Save(f, s, rng); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read a game saved by SaveFile.
+func LoadFile(u *Universe, name string) (*State, *RNG, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return Load(u, f)
+}
+
+// Read a game saved by Save.  The game must have been saved from a Universe
+// with the same Fingerprint as u.
+func Load(u *Universe, r io.Reader) (*State, *RNG, error) {
+	var g savedGame
+	if err := json.NewDecoder(r).Decode(&g); err != nil {
+		return nil, nil, err
+	}
+	if g.Version != SaveVersion {
+		return nil, nil, fmt.Errorf("saved game is version %d, expected %d", g.Version, SaveVersion)
+	}
+	if g.Story != u.Fingerprint() {
+		return nil, nil, errors.New("saved game is from a different story")
+	}
+	if len(g.History) == 0 || g.Now < 0 || g.Now >= len(g.History) {
+		return nil, nil, errors.New("saved game has no current moment")
+	}
+
+	byKey := map[string]*Transition{}
+	for t, key := range u.transitionKeys() {
+		byKey[key] = t
+	}
+
+	s := &State{universe: u}
+	moments := make([]*Moment, len(g.History))
+	for i, sm := range g.History {
+		if sm.Parent >= i || (sm.Parent < 0) != (i == 0) {
+			return nil, nil, errors.New("saved game's history is out of order")
+		}
+		m := &Moment{universe: u, values: map[*Factor]Value{}, label: sm.Label, turn: sm.Turn, since: map[*Transition]int{}}
+		if i > 0 {
+			m.past = moments[sm.Parent]
+			m.past.branches = append(m.past.branches, m)
+		}
+		if sm.Cause != "" {
+			if m.cause = byKey[sm.Cause]; m.cause == nil {
+				return nil, nil, errors.New("saved game refers to unknown transition " + sm.Cause)
+			}
+		}
+		if sm.Outcome != 0 {
+			if m.cause == nil || sm.Outcome < 0 || sm.Outcome > len(m.cause.outcomes) {
+				return nil, nil, errors.New("saved game refers to an unknown outcome of " + sm.Cause)
+			}
+			m.outcome = m.cause.outcomes[sm.Outcome-1]
+		}
+		for _, f := range u.factorOrder {
+			v, ok := sm.Values[f.label]
+			if !ok || !f.Possible(Value(v)) {
+				return nil, nil, errors.New("saved game has a bad value for " + f.label)
+			}
+			m.values[f] = Value(v)
+		}
+		for key, turn := range sm.Since {
+			t := byKey[key]
+			if t == nil {
+				return nil, nil, errors.New("saved game refers to unknown transition " + key)
+			}
+			m.since[t] = turn
+		}
+		moments[i] = m
+	}
+	for i, sm := range g.History {
+		if sm.Future >= 0 {
+			if sm.Future >= len(moments) || moments[sm.Future].past != moments[i] {
+				return nil, nil, errors.New("saved game's history is out of order")
+			}
+			moments[i].future = moments[sm.Future]
+		}
+	}
+	s.now = moments[g.Now]
+	rng := RestoreRNG(g.Seed, g.Position)
+	s.rng = rng.Rand
+
+	return s, rng, nil
+}
+
+// Transitions are saved by label, or by their position in the Universe if
+// they don't have a label of their own.
+func (u *Universe) transitionKeys() map[*Transition]string {
+	count := map[string]int{}
+	for _, t := range u.transitions {
+		count[t.label]++
+	}
+	keys := map[*Transition]string{}
+	for i, t := range u.transitions {
+		if t.label != "" && count[t.label] == 1 {
+			keys[t] = t.label
+		} else {
+			keys[t] = "#" + strconv.Itoa(i)
+		}
+	}
+	return keys
+}
+
+// A summary of the shape of a Universe: its factors, their values, and its
+// transitions and how many outcomes they have.  Universes with the same
+// fingerprint can share saved games.
+func (u *Universe) Fingerprint() string {
+	h := sha1.New()
+	for _, f := range u.factorOrder {
+		io.WriteString(h, "factor "+f.label)
+		if f.numeric {
+			fmt.Fprintf(h, " %d:%d", f.min, f.max)
+		} else {
+			var vs []string
+			for v, _ := range f.possible {
+				vs = append(vs, string(v))
+			}
+			sort.Strings(vs)
+			for _, v := range vs {
+				io.WriteString(h, " "+v)
+			}
+		}
+		io.WriteString(h, "\n")
+	}
+	keys := u.transitionKeys()
+	for _, t := range u.transitions {
+		io.WriteString(h, "transition "+keys[t])
+		if len(t.outcomes) > 0 {
+			fmt.Fprintf(h, " %d outcomes", len(t.outcomes))
+		}
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,86 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Controlling which spontaneous transitions happen in a turn, so that
+	events that contradict each other don't happen together: priorities,
+	Exclusive groups, and settling.
+*/
+
+package state
+
+// An Exclusive is a group of transitions of which only one can happen a turn.
+type Exclusive struct {
+	label       string
+	transitions []*Transition
+}
+
+// Make only one of ts able to happen each turn.  A Transition can be in more
+// than one group.
+func (u *Universe) AddExclusive(label string, ts []*Transition) *Exclusive {
+	g := &Exclusive{label, append([]*Transition(nil), ts...)}
+	for _, t := range ts {
+		t.exclusives = append(t.exclusives, g)
+	}
+	u.exclusives = append(u.exclusives, g)
+	return g
+}
+
+// All of the Exclusive groups, in the order they were added.
+func (u *Universe) Exclusives() []*Exclusive {
+	return append([]*Exclusive(nil), u.exclusives...)
+}
+
+func (g Exclusive) Label() string {
+	return g.label
+}
+
+func (g Exclusive) Transitions() []*Transition {
+	return append([]*Transition(nil), g.transitions...)
+}
+
+// Whether t is in a group that something has already happened in.
+func (t *Transition) excluded(used map[*Exclusive]bool) bool {
+	for _, g := range t.exclusives {
+		if used[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// Spontaneous transitions with higher priorities are tried before ones with
+// lower priorities.  The default is 0.
+func (t *Transition) SetPriority(n int) {
+	t.priority = n
+}
+
+func (t Transition) Priority() int {
+	return t.priority
+}
+
+// Whether RunSpontaneous keeps going until nothing more happens, trying
+// transitions in the order they were added.
+func (u *Universe) SetSettle(settle bool) {
+	u.settle = settle
+}
+
+func (u Universe) Settles() bool {
+	return u.settle
+}
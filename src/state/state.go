@@ -27,32 +27,49 @@
 package state
 
 import (
+	"errors"
+	"fmt"
 	"strings"
+	"strconv"
 	"math/rand"
+	"sort"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
 
 // A Universe is a collection of Factors. Each Factor has a set of possible
 // Values and an initial Value. A State of a Universe gives “current” Values
-// for every Factor.
+// for every Factor.  A numeric Factor's possible Values are the integers in
+// its range, written out in decimal.  Factors and Transitions are kept in the
+// order they were added, so that everything about a Universe (like the order
+// choices are offered in) is the same every time it's run.
 
 type Value string
 
 type Universe struct {
-	factors     map[string]*Factor
-	transitions map[*Transition]bool
+	factors      map[string]*Factor
+	factorOrder  []*Factor
+	transitions  []*Transition
+	descriptions []*Description
+	endings      []*Ending
+	duplicates   []*Factor // factors whose labels were already declared
+	exclusives   []*Exclusive
+	settle       bool // run spontaneous transitions until nothing more happens
 }
 
 type Factor struct {
 	label    string
 	initial  Value
 	possible map[Value]bool
+	values   []Value // possible, in the order they were given
+	numeric  bool
+	min, max int
 }
 
 type State struct {
 	universe *Universe
 	now      *Moment
+	rng      *rand.Rand // for picking Outcomes
 }
 
 // A Transition defines a change in the State. Each transition has:
@@ -61,16 +78,47 @@ type State struct {
 //   a schedule, which determines when it occurs when it can
 //   a description, which the player sees when it happens
 //   effects, which are modifications to the state
+//   deltas, which are amounts to add to numeric factors
+//   outcomes, of which one is picked at random when it happens, if it has any
+//   a priority, which decides which spontaneous transitions are tried first
 type Transition struct {
 	label       string
 	condition   BoolExpr
 	schedule    Schedule
 	description string
 	effects     map[*Factor]Value
+	deltas      map[*Factor]int
+	outcomes    []*Outcome
+	priority    int
+	exclusives  []*Exclusive // groups it's in
+
+	// Filled in versions of the description and choice, if there are any
+	template       Template
+	choiceTemplate Template
+}
+
+// A Description is text that describes how things are whenever its condition
+// holds, like the description of the room the player is in.
+type Description struct {
+	condition BoolExpr
+	text      string
+	template  Template
 }
 
+// An Ending finishes the story as soon as its condition holds.  Nothing more
+// can happen after that.
+type Ending struct {
+	label     string
+	condition BoolExpr
+	text      string
+	template  Template
+}
+
+// A Schedule decides whether a Transition happens at the end of a turn,
+// given how many turns have gone by and for how many of them its condition
+// has held.
 type Schedule interface {
-	now(*rand.Rand) bool
+	now(r *rand.Rand, turn int, held int) bool
 	ask() bool
 	ChoiceDescription() string
 }
@@ -83,23 +131,48 @@ type Chosen struct {
 	Description string
 }
 
+// An After happens once its condition has held for Turns turns in a row.
+type After struct {
+	Turns int
+}
+
+// An Every happens every Turns turns for as long as its condition holds.
+type Every struct {
+	Turns int
+}
+
+// An AtTurn happens at the end of one particular turn, if its condition
+// holds then.  Turn 0 is the start of the story.
+type AtTurn struct {
+	Turn int
+}
+
+// Moments form a tree: going back to an earlier Moment and doing something
+// different starts a new branch, without losing the old one.  Each Moment's
+// future is whichever of its branches was followed most recently.
 type Moment struct {
 	universe *Universe
 	values   map[*Factor]Value
 	future   *Moment // TODO should be read-only
 	past     *Moment
 	cause    *Transition
+	outcome  *Outcome
+	branches []*Moment
+	label    string
+
+	turn  int                 // the turn this Moment came about in
+	since map[*Transition]int // when timed transitions' conditions began holding
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
 func NewUniverse() *Universe {
-	return &Universe{map[string]*Factor{}, map[*Transition]bool{}}
+	return &Universe{map[string]*Factor{}, nil, nil, nil, nil, nil, nil, false}
 }
 
 func (u Universe) String() string {
 	return listing("Universe[", "]", func(write func(string)) {
-		for _, f := range u.factors {
+		for _, f := range u.factorOrder {
 			write(f.String())
 		}
 	})
@@ -108,35 +181,133 @@ func (u Universe) String() string {
 // Note: Result is in an invalid state as its initial value is not a possible
 // value (and it has no possible values).
 func newFactor(label string) *Factor {
-	return &Factor{label, Value(""), map[Value]bool{}}
+	return &Factor{label, Value(""), map[Value]bool{}, nil, false, 0, 0}
 }
 
 func (f Factor) String() string {
+	if f.numeric {
+		return "{" + f.label + " [" + strconv.Itoa(f.min) + ":" + strconv.Itoa(f.max) + "] " + string(f.initial) + "}"
+	}
 	return listing("{"+f.label+" [", "] "+string(f.initial)+"}", func(write func(string)) {
-		for v, _ := range f.possible {
+		for _, v := range f.values {
 			write(string(v))
 		}
 	})
 }
 
 func (u *Universe) AddFactor(label string, initial string, values []string) *Factor {
-	// TODO: check if name is in use
 	f := newFactor(label)
 	for _, v := range values {
+		if !f.possible[Value(v)] {
+			f.values = append(f.values, Value(v))
+		}
 		f.possible[Value(v)] = true
 	}
 	f.initial = Value(initial)
-	u.factors[label] = f
+	u.addFactor(f)
 	return f
 }
 
+// Add a Factor whose values are the integers from min to max.
+func (u *Universe) AddNumericFactor(label string, initial int, min int, max int) *Factor {
+	f := newFactor(label)
+	f.numeric = true
+	f.min, f.max = min, max
+	f.initial = Value(strconv.Itoa(initial))
+	u.addFactor(f)
+	return f
+}
+
+// A Factor declared twice replaces the first one, but keeps its place.
+func (u *Universe) addFactor(f *Factor) {
+	if old, used := u.factors[f.label]; used {
+		u.duplicates = append(u.duplicates, f)
+		for i, g := range u.factorOrder {
+			if g == old {
+				u.factorOrder[i] = f
+			}
+		}
+	} else {
+		u.factorOrder = append(u.factorOrder, f)
+	}
+	u.factors[f.label] = f
+}
+
+// All of the Factors, in the order they were added.
+func (u *Universe) Factors() []*Factor {
+	return append([]*Factor(nil), u.factorOrder...)
+}
+
+// All of the Transitions, in the order they were added.
+func (u *Universe) Transitions() []*Transition {
+	return append([]*Transition(nil), u.transitions...)
+}
+
+// Whether v is one of the values f can take.
+func (f *Factor) Possible(v Value) bool {
+	if f.numeric {
+		n, err := strconv.Atoi(string(v))
+		return err == nil && n >= f.min && n <= f.max
+	}
+	return f.possible[v]
+}
+
+func (f *Factor) SetInitial(v Value) {
+	f.initial = v
+}
+
+func (f *Factor) Initial() Value {
+	return f.initial
+}
+
+// The values of a non-numeric factor, in the order they were given.
+func (f *Factor) Values() []Value {
+	return append([]Value(nil), f.values...)
+}
+
+// The range of a numeric factor.
+func (f *Factor) Range() (min int, max int) {
+	return f.min, f.max
+}
+
+func (f *Factor) Numeric() bool {
+	return f.numeric
+}
+
+func (f *Factor) Label() string {
+	return f.label
+}
+
 func (u *Universe) AddTransition(label string, condition BoolExpr, schedule Schedule, description string, effects map[*Factor]Value) *Transition {
 	// TODO: deepcopy maps or otherwise avoid aliasing
-	t := &Transition{label, condition, schedule, description, effects}
-	u.transitions[t] = true
+	t := &Transition{label, condition, schedule, description, effects, map[*Factor]int{}, nil, 0, nil, nil, nil}
+	u.transitions = append(u.transitions, t)
 	return t
 }
 
+// Make t add n to the numeric factor f when it happens.  The result is kept
+// within f's range.
+func (t *Transition) AddDelta(f *Factor, n int) {
+	t.deltas[f] += n
+}
+
+func (u *Universe) AddDescription(condition BoolExpr, text string) *Description {
+	d := &Description{condition, text, nil}
+	u.descriptions = append(u.descriptions, d)
+	return d
+}
+
+func (u *Universe) AddEnding(label string, condition BoolExpr, text string) *Ending {
+	e := &Ending{label, condition, text, nil}
+	u.endings = append(u.endings, e)
+	return e
+}
+
+// All of the Endings, in the order they were added.
+func (u *Universe) Endings() []*Ending {
+	return append([]*Ending(nil), u.endings...)
+}
+
 func newState(u *Universe, initial map[*Factor]Value) *State {
 	var s State
 	var m Moment
@@ -144,24 +315,50 @@ func newState(u *Universe, initial map[*Factor]Value) *State {
 	s.now = &m
 	m.universe = u
 	m.values = copyMap(initial)
+	m.since = map[*Transition]int{}
 	return &s
 }
 
 // Create a State of this Universe with initial values.
 func (u *Universe) Instantiate() *State {
 	vs := map[*Factor]Value{}
-	for _, f := range u.factors {
+	for _, f := range u.factorOrder {
 		vs[f] = f.initial
 	}
 	return newState(u, vs)
 }
 
+// Create a State of this Universe, starting with some factors set to something
+// other than their initial values.  overrides maps factor labels to values.
+func (u *Universe) InstantiateWith(overrides map[string]string) (*State, error) {
+	vs := map[*Factor]Value{}
+	for _, f := range u.factorOrder {
+		vs[f] = f.initial
+	}
+	for label, v := range overrides {
+		f := u.factors[label]
+		if f == nil {
+			return nil, errors.New("no factor named " + label)
+		}
+		if !f.Possible(Value(v)) {
+			return nil, errors.New(v + " is not a value of " + label)
+		}
+		if f.numeric {
+			// So that, say, 07 is stored the same way as 7
+			n, _ := strconv.Atoi(v)
+			v = strconv.Itoa(n)
+		}
+		vs[f] = Value(v)
+	}
+	return newState(u, vs), nil
+}
+
 func (s State) String() string {
 	u := s.universe
 	return listing("State[", "]", func(write func(string)) {
-		for _, f := range u.factors {
+		for _, f := range u.factorOrder {
 			v := s.now.values[f]
-			_, valid := f.possible[v]
+			valid := f.Possible(v)
 			var note string
 			if valid {
 				note = ""
@@ -175,8 +372,11 @@ func (s State) String() string {
 
 // TODO: Should this return something finer than just a Transition?
 func (s *State) PossibleTransitions() []*Transition {
+	if s.Ended() {
+		return nil
+	}
 	var ts []*Transition
-	for t, _ := range s.universe.transitions {
+	for _, t := range s.universe.transitions {
 		if t.condition.Evaluate(s) {
 			ts = append(ts, t)
 		}
@@ -184,18 +384,129 @@ func (s *State) PossibleTransitions() []*Transition {
 	return ts
 }
 
+// Give each possible spontaneous transition its chance to happen, and end the
+// turn.  Those with higher priorities are tried first; ones with the same
+// priority are tried in an order shuffled by r, so that none is favoured over
+// the others, but the same r always gives the same result.  Once one
+// transition in an Exclusive group has happened, the rest of the group can't
+// this turn.
+//
+// If the Universe settles, transitions are tried in the order they were
+// added instead of shuffled, and once they all have been, any that have
+// become possible since get their chance too, until nothing more happens.
+// Each transition still only gets one chance a turn.
+//
+// The end of the turn is itself recorded as a Moment with no cause, which the
+// transitions that happen follow, so that going back to an earlier Moment
+// never changes it.
 func (s *State) RunSpontaneous(r *rand.Rand) {
-	// TODO: Need to do this loop in random order for unbiased operation.
-	for _, t := range s.PossibleTransitions() {
-		// The condition is reevaluated in case a previously run transition changed things.
-		if t.schedule.now(r) && t.condition.Evaluate(s) {
-			//fmt.Printf("[Running spontaneous transition %v]\n", t)
-			t.Apply(s)
+	turn := s.Turn()
+	s.wait(turn)
+	tried := map[*Transition]bool{}
+	used := map[*Exclusive]bool{}
+	for {
+		var ts []*Transition
+		for _, t := range s.PossibleTransitions() {
+			if !tried[t] {
+				ts = append(ts, t)
+			}
+		}
+		if !s.universe.settle {
+			shuffled := make([]*Transition, len(ts))
+			for i, j := range r.Perm(len(ts)) {
+				shuffled[i] = ts[j]
+			}
+			ts = shuffled
+		}
+		sort.SliceStable(ts, func(i, j int) bool { return ts[i].priority > ts[j].priority })
+
+		happened := false
+		for _, t := range ts {
+			tried[t] = true
+			if t.excluded(used) {
+				continue
+			}
+			held := 0
+			if since, ok := s.now.since[t]; ok {
+				held = turn - since
+			}
+			// The condition is reevaluated in case a previously run transition changed things.
+			if t.schedule.now(r, turn, held) && t.condition.Evaluate(s) {
+				//fmt.Printf("[Running spontaneous transition %v]\n", t)
+				t.ApplyOutcome(s, t.pick(r))
+				for _, g := range t.exclusives {
+					used[g] = true
+				}
+				happened = true
+			}
+		}
+		if !s.universe.settle || !happened {
+			break
+		}
+	}
+}
+
+// Move on to a new Moment for the end of the given turn, noting down which
+// timed transitions' conditions have started holding and forgetting the ones
+// that have stopped.
+func (s *State) wait(turn int) {
+	var newNow Moment
+	newNow.universe = s.universe
+	newNow.turn = turn + 1
+	newNow.values = copyMap(s.now.values)
+	newNow.since = map[*Transition]int{}
+	for t, n := range s.now.since {
+		newNow.since[t] = n
+	}
+	for _, t := range s.universe.transitions {
+		if !timed(t.schedule) {
+			continue
+		}
+		_, held := newNow.since[t]
+		switch now := t.condition.Evaluate(s); {
+		case now && !held:
+			newNow.since[t] = turn
+		case !now && held:
+			delete(newNow.since, t)
 		}
 	}
+
+	newNow.past = s.now
+	s.now.future = &newNow
+	s.now.branches = append(s.now.branches, &newNow)
+	s.now = &newNow
+}
+
+// Whether a schedule depends on how long its transition's condition has held.
+func timed(sc Schedule) bool {
+	switch sc.(type) {
+	case After, Every:
+		return true
+	}
+	return false
+}
+
+// Use r to pick between transitions' outcomes when they're applied.
+func (s *State) SetRand(r *rand.Rand) {
+	s.rng = r
+}
+
+// The random numbers for picking outcomes.  A State that hasn't been given
+// any uses seed 0.
+func (s *State) random() *rand.Rand {
+	if s.rng == nil {
+		s.rng = rand.New(rand.NewSource(0))
+	}
+	return s.rng
+}
+
+// How many turns have ended since the story began.
+func (s *State) Turn() int {
+	return s.now.turn
 }
 
-// Return all user-selectable transitions for the current state.
+// Return all user-selectable transitions for the current state, in the order
+// they were added.
 func (s *State) ChosenTransitions() []*Transition {
 	var ts []*Transition
 	for _, t := range s.PossibleTransitions() {
@@ -206,14 +517,86 @@ func (s *State) ChosenTransitions() []*Transition {
 	return ts
 }
 
+// The first choice available now with the given label or choice text, or nil
+// if there isn't one.
+func (s *State) FindChoice(text string) *Transition {
+	for _, t := range s.ChosenTransitions() {
+		if t.label == text || t.Choice(s) == text {
+			return t
+		}
+	}
+	return nil
+}
+
+// Return the text of every description whose condition currently holds, in
+// the order they were added.
+func (s *State) Descriptions() []string {
+	var texts []string
+	for _, d := range s.universe.descriptions {
+		if d.condition.Evaluate(s) {
+			texts = append(texts, fill(d.template, d.text, s))
+		}
+	}
+	return texts
+}
+
+// The Ending the story has reached, or nil if it's still going.  If more than
+// one Ending's condition holds, the first one added wins.
+func (s *State) Ending() *Ending {
+	for _, e := range s.universe.endings {
+		if e.condition.Evaluate(s) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *State) Ended() bool {
+	return s.Ending() != nil
+}
+
 func (s *State) Get(f *Factor) Value {
 	return s.now.values[f]
 }
 
+// Get the value of a numeric factor as a number.
+func (s *State) GetInt(f *Factor) int {
+	n, _ := strconv.Atoi(string(s.now.values[f]))
+	return n
+}
+
+func (d Description) Text() string {
+	return d.text
+}
+
+func (e Ending) Label() string {
+	return e.label
+}
+
+func (e Ending) Condition() BoolExpr {
+	return e.condition
+}
+
+func (e Ending) Text() string {
+	return e.text
+}
+
 func (t Transition) String() string {
 	return "{" + t.label + "...}"
 }
 
+func (t Transition) Label() string {
+	return t.label
+}
+
+func (t Transition) Condition() BoolExpr {
+	return t.condition
+}
+
+func (t Transition) Schedule() Schedule {
+	return t.schedule
+}
+
 func (t Transition) Description() string {
 	return t.description
 }
@@ -222,31 +605,84 @@ func (t Transition) ChoiceDescription() string {
 	return t.schedule.ChoiceDescription()
 }
 
+// Whether the player chooses this transition, rather than it happening by
+// itself.
+func (t Transition) IsChoice() bool {
+	return t.schedule.ask()
+}
+
+// Make t happen.  If it has outcomes, one is picked with the State's random
+// numbers.
 func (t *Transition) Apply(s *State) {
+	t.ApplyOutcome(s, t.pick(s.random()))
+}
+
+// Make t happen and turn out as o, which must be one of its outcomes, or nil
+// for none of them.
+func (t *Transition) ApplyOutcome(s *State, o *Outcome) {
 	var newNow Moment
 	newNow.universe = s.universe
 	newNow.cause = t
+	newNow.outcome = o
+	newNow.turn = s.Turn()
+	newNow.since = map[*Transition]int{}
+	for other, n := range s.now.since {
+		newNow.since[other] = n
+	}
 
 	newNow.values = copyMap(s.now.values)
-	for f, v := range t.effects {
-		newNow.values[f] = v
+	change(newNow.values, t.effects, t.deltas)
+	if o != nil {
+		change(newNow.values, o.effects, o.deltas)
 	}
 
 	newNow.past = s.now
 	s.now.future = &newNow
+	s.now.branches = append(s.now.branches, &newNow)
 
 	s.now = &newNow
 }
 
+// Sets and adds to values.  Numbers are kept within their factors' ranges.
+func change(values map[*Factor]Value, effects map[*Factor]Value, deltas map[*Factor]int) {
+	for f, v := range effects {
+		values[f] = v
+	}
+	for f, n := range deltas {
+		if !f.numeric {
+			continue
+		}
+		v, _ := strconv.Atoi(string(values[f]))
+		v += n
+		if v < f.min {
+			v = f.min
+		} else if v > f.max {
+			v = f.max
+		}
+		values[f] = Value(strconv.Itoa(v))
+	}
+}
+
 // interface methods
-func (s Spontaneous) now(r *rand.Rand) bool {
+func (s Spontaneous) now(r *rand.Rand, turn int, held int) bool {
 	return r.Float64() <= s.ProbabilityPerTurn
 }
-func (_ Spontaneous) ask() bool                 { return false }
-func (_ Spontaneous) ChoiceDescription() string { return "Missingno" }
-func (_ Chosen) now(r *rand.Rand) bool          { return false }
-func (_ Chosen) ask() bool                      { return true }
-func (c Chosen) ChoiceDescription() string      { return c.Description }
+func (_ Spontaneous) ask() bool                            { return false }
+func (_ Spontaneous) ChoiceDescription() string            { return "Missingno" }
+func (_ Chosen) now(r *rand.Rand, turn int, held int) bool { return false }
+func (_ Chosen) ask() bool                                 { return true }
+func (c Chosen) ChoiceDescription() string                 { return c.Description }
+func (a After) now(r *rand.Rand, turn int, held int) bool  { return held == a.Turns }
+func (_ After) ask() bool                                  { return false }
+func (a After) ChoiceDescription() string                  { return "after " + strconv.Itoa(a.Turns) }
+func (e Every) now(r *rand.Rand, turn int, held int) bool {
+	return held > 0 && e.Turns > 0 && held%e.Turns == 0
+}
+func (_ Every) ask() bool                                  { return false }
+func (e Every) ChoiceDescription() string                  { return "every " + strconv.Itoa(e.Turns) }
+func (a AtTurn) now(r *rand.Rand, turn int, held int) bool { return turn == a.Turn }
+func (_ AtTurn) ask() bool                                 { return false }
+func (a AtTurn) ChoiceDescription() string                 { return "at turn " + strconv.Itoa(a.Turn) }
 
 ////////////////////////////////////////////////////////////////////////////////
 
@@ -261,6 +697,26 @@ type FactorEquals struct {
 	Value  Value
 }
 
+// A Compare compares a numeric factor with a number.
+type Compare struct {
+	Factor *Factor
+	Op     Comparison
+	Value  int
+}
+
+type Comparison int
+
+const (
+	Less Comparison = iota
+	LessEq
+	Greater
+	GreaterEq
+)
+
+type Not struct {
+	Clause BoolExpr
+}
+
 type And struct {
 	Clauses []BoolExpr
 }
@@ -269,10 +725,48 @@ type Or struct {
 	Clauses []BoolExpr
 }
 
+func MkNot(clause BoolExpr) Not {
+	return Not{clause}
+}
+
+func MkAnd(clauses ...BoolExpr) And {
+	return And{clauses}
+}
+
+func MkOr(clauses ...BoolExpr) Or {
+	return Or{clauses}
+}
+
 func (e FactorEquals) Evaluate(s *State) bool {
 	return s.now.values[e.Factor] == e.Value
 }
 
+func (e Compare) Evaluate(s *State) bool {
+	v, err := strconv.Atoi(string(s.now.values[e.Factor]))
+	if err != nil {
+		return false
+	}
+	switch e.Op {
+	case Less:
+		return v < e.Value
+	case LessEq:
+		return v <= e.Value
+	case Greater:
+		return v > e.Value
+	case GreaterEq:
+		return v >= e.Value
+	}
+	return false
+}
+
+func (c Comparison) String() string {
+	return [...]string{"<", "<=", ">", ">="}[c]
+}
+
+func (e Not) Evaluate(s *State) bool {
+	return !e.Clause.Evaluate(s)
+}
+
 func (e And) Evaluate(s *State) bool {
 	for _, e := range e.Clauses {
 		if !e.Evaluate(s) {
@@ -291,6 +785,66 @@ func (e Or) Evaluate(s *State) bool {
 	return false
 }
 
+// Conditions print the way they're written in a story.
+
+func (e FactorEquals) String() string {
+	return factorLabel(e.Factor) + " = " + string(e.Value)
+}
+
+func (e Compare) String() string {
+	return factorLabel(e.Factor) + " " + e.Op.String() + " " + strconv.Itoa(e.Value)
+}
+
+func (e Not) String() string {
+	if eq, ok := e.Clause.(FactorEquals); ok {
+		return factorLabel(eq.Factor) + " != " + string(eq.Value)
+	}
+	return "not " + clauseString(e.Clause)
+}
+
+func (e And) String() string {
+	return joinClauses(e.Clauses, " & ")
+}
+
+func (e Or) String() string {
+	return joinClauses(e.Clauses, " | ")
+}
+
+func joinClauses(clauses []BoolExpr, sep string) string {
+	if len(clauses) == 1 {
+		return fmt.Sprint(clauses[0])
+	}
+	parts := make([]string, len(clauses))
+	for i, c := range clauses {
+		parts[i] = clauseString(c)
+	}
+	return strings.Join(parts, sep)
+}
+
+// A condition inside another one, in parentheses if it has parts of its own.
+func clauseString(e BoolExpr) string {
+	switch c := e.(type) {
+	case And:
+		if len(c.Clauses) == 1 {
+			return clauseString(c.Clauses[0])
+		}
+		return "(" + c.String() + ")"
+	case Or:
+		if len(c.Clauses) == 1 {
+			return clauseString(c.Clauses[0])
+		}
+		return "(" + c.String() + ")"
+	}
+	return fmt.Sprint(e)
+}
+
+func factorLabel(f *Factor) string {
+	if f == nil {
+		return "?"
+	}
+	return f.label
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // History access
@@ -299,10 +853,59 @@ func (s *State) Now() *Moment {
 	return s.now
 }
 
+// Go to any Moment in the history.  Every Moment on the way there from the
+// beginning has its future switched to the branch leading to m, so that
+// Future() retraces the path to it.
 func (s *State) Goto(m *Moment) {
+	for c := m; c.past != nil; c = c.past {
+		c.past.future = c
+	}
 	s.now = m
 }
 
+// The first Moment in the history.
+func (s *State) Beginning() *Moment {
+	m := s.now
+	for m.past != nil {
+		m = m.past
+	}
+	return m
+}
+
+// Find the Moment with the given label anywhere in the history, or nil.
+func (s *State) FindLabel(label string) *Moment {
+	var found *Moment
+	s.Beginning().walk(func(m *Moment) {
+		if found == nil && m.label == label {
+			found = m
+		}
+	})
+	return found
+}
+
+// Calls visit for m and everything after it, on every branch, parents before
+// children.
+func (m *Moment) walk(visit func(*Moment)) {
+	visit(m)
+	for _, b := range m.branches {
+		b.walk(visit)
+	}
+}
+
+// All of the Moments that have followed this one, oldest first.
+func (m Moment) Branches() []*Moment {
+	return append([]*Moment(nil), m.branches...)
+}
+
+// A name for this Moment, so a player can come back to it.
+func (m *Moment) SetLabel(label string) {
+	m.label = label
+}
+
+func (m Moment) Label() string {
+	return m.label
+}
+
 func (m Moment) Future() *Moment {
 	return m.future
 }
@@ -315,6 +918,29 @@ func (m Moment) Cause() *Transition {
 	return m.cause
 }
 
+// The most recent Moment, up to and including m, that the player chose, or
+// nil if they haven't chosen anything yet.
+func (m *Moment) LastChoice() *Moment {
+	for m != nil && !m.chosen() {
+		m = m.past
+	}
+	return m
+}
+
+// Follows m's future to the last thing that happened before the player's
+// next choice.
+func (m *Moment) EndOfTurn() *Moment {
+	for m.future != nil && !m.future.chosen() {
+		m = m.future
+	}
+	return m
+}
+
+// Whether the player chose to bring m about.
+func (m *Moment) chosen() bool {
+	return m.cause != nil && m.cause.IsChoice()
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func copyMap(in map[*Factor]Value) map[*Factor]Value {
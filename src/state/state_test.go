@@ -2,6 +2,11 @@ package state_test
 
 import (
 	"state"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"math/rand"
 )
@@ -47,6 +52,10 @@ func Test_BoolExpr(t *testing.T) {
 	assert(t, "Or 1", false, state.MkOr(fals, fals).Evaluate(s))
 	assert(t, "Or 2", true, state.MkOr(tru, fals).Evaluate(s))
 	assert(t, "Or 3", false, state.MkOr().Evaluate(s))
+
+	// Not
+	assert(t, "Not 1", false, state.MkNot(tru).Evaluate(s))
+	assert(t, "Not 2", true, state.MkNot(fals).Evaluate(s))
 }
 
 func Test_Spontaneous(t *testing.T) {
@@ -152,7 +161,656 @@ func Test_UndoRedo(t *testing.T) {
 	assert(t, "Redo", state.Value("b"), s.Get(f))
 }
 
+func Test_Validate(t *testing.T) {
+	u, _, f := initial()
+	g := u.AddFactor("empty", "", nil)
+	u.AddFactor("b-factor", "a", []string{"a"})
+	u.AddFactor("b-factor", "a", []string{"a"})
+	u.AddTransition("bad-value",
+		state.FactorEquals{f, "z"},
+		state.Chosen{"Go."},
+		"",
+		map[*state.Factor]state.Value{f: "y"})
+	u.AddTransition("no-factor",
+		state.FactorEquals{nil, "a"},
+		state.Chosen{"Go."},
+		"",
+		map[*state.Factor]state.Value{g: "b"})
+	u.AddTransition("no-op",
+		state.FactorEquals{f, "a"},
+		state.Chosen{"Stay."},
+		"You stay put.",
+		map[*state.Factor]state.Value{f: "a"})
+	u.AddTransition("no-op",
+		state.FactorEquals{f, "b"},
+		state.Chosen{"Go."},
+		"",
+		map[*state.Factor]state.Value{f: "c"})
+
+	err := u.Validate()
+	errs, ok := err.(state.ValidationErrors)
+	if !assert(t, "Validation errors", true, ok) {
+		return
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	sort.Strings(got)
+	want := []string{
+		"factor b-factor: declared more than once",
+		"factor empty: has no values",
+		"transition bad-value: condition compares a-factor to unknown value z",
+		"transition bad-value: effect sets a-factor to unknown value y",
+		"transition no-factor: condition refers to an undeclared factor",
+		"transition no-factor: effect sets empty to unknown value b",
+		"transition no-op: declared more than once",
+		"warning: transition no-op: effects never change anything",
+	}
+	if assert(t, "Problem count", len(want), len(got)) {
+		for i := range want {
+			assert(t, "Problem", want[i], got[i])
+		}
+	}
+	assert(t, "Fatal", true, errs.Fatal())
+}
+
+func Test_ValidateClean(t *testing.T) {
+	u, _, f := initial()
+	u.AddTransition("a-transition",
+		state.FactorEquals{f, "a"},
+		state.Chosen{"Go."},
+		"",
+		map[*state.Factor]state.Value{f: "b"})
+	assert(t, "No problems", nil, u.Validate())
+}
+
+func Test_Descriptions(t *testing.T) {
+	u, _, f := initial()
+	u.AddDescription(state.FactorEquals{f, "a"}, "It is a.")
+	u.AddDescription(state.FactorEquals{f, "b"}, "It is b.")
+	u.AddDescription(state.MkOr(state.FactorEquals{f, "a"}, state.FactorEquals{f, "b"}), "It is not c.")
+	tr := u.AddTransition("a-transition",
+		state.FactorEquals{f, "a"},
+		state.Chosen{"Go."},
+		"",
+		map[*state.Factor]state.Value{f: "c"})
+	s := u.Instantiate()
+
+	ds := s.Descriptions()
+	if assert(t, "Initial descriptions", 2, len(ds)) {
+		assert(t, "First description", "It is a.", ds[0])
+		assert(t, "Second description", "It is not c.", ds[1])
+	}
+	tr.Apply(s)
+	assert(t, "No descriptions", 0, len(s.Descriptions()))
+}
+
+func Test_Numeric(t *testing.T) {
+	u, _, f := initial()
+	gold := u.AddNumericFactor("gold", 5, 0, 10)
+	earn := u.AddTransition("earn",
+		state.Compare{gold, state.Less, 10},
+		state.Chosen{"Work."},
+		"",
+		map[*state.Factor]state.Value{})
+	earn.AddDelta(gold, 4)
+	spend := u.AddTransition("spend",
+		state.Compare{gold, state.GreaterEq, 3},
+		state.Chosen{"Shop."},
+		"",
+		map[*state.Factor]state.Value{f: "b"})
+	spend.AddDelta(gold, -3)
+	s := u.Instantiate()
+
+	assert(t, "Initial gold", 5, s.GetInt(gold))
+	earn.Apply(s)
+	assert(t, "Earned", 9, s.GetInt(gold))
+	earn.Apply(s)
+	assert(t, "Clamped to max", 10, s.GetInt(gold))
+	assert(t, "Can't earn at max", false, state.Compare{gold, state.Less, 10}.Evaluate(s))
+	for i := 0; i < 4; i++ {
+		spend.Apply(s)
+	}
+	assert(t, "Clamped to min", 0, s.GetInt(gold))
+	assert(t, "Can't spend when broke", false, state.Compare{gold, state.GreaterEq, 3}.Evaluate(s))
+	assert(t, "Equals on numbers", true, state.FactorEquals{gold, "0"}.Evaluate(s))
+	assert(t, "Numeric universe valid", nil, u.Validate())
+
+	bad := u.AddTransition("bad",
+		state.Compare{f, state.Greater, 1},
+		state.Chosen{"Go."},
+		"",
+		map[*state.Factor]state.Value{gold: "11"})
+	bad.AddDelta(f, 1)
+	errs := u.Validate().(state.ValidationErrors)
+	assert(t, "Numeric problems", 3, len(errs))
+}
+
+func Test_InstantiateWith(t *testing.T) {
+	u, _, f := initial()
+	gold := u.AddNumericFactor("gold", 0, 0, 10)
+
+	s, err := u.InstantiateWith(map[string]string{"a-factor": "c", "gold": "7"})
+	assert(t, "No error", nil, err)
+	assert(t, "Overridden", state.Value("c"), s.Get(f))
+	assert(t, "Overridden number", 7, s.GetInt(gold))
+	s, err = u.InstantiateWith(map[string]string{"gold": "07"})
+	assert(t, "Leading zero", nil, err)
+	assert(t, "Leading zero dropped", state.Value("7"), s.Get(gold))
+
+	_, err = u.InstantiateWith(map[string]string{"a-factor": "d"})
+	assert(t, "Bad value", true, err != nil)
+	_, err = u.InstantiateWith(map[string]string{"gold": "11"})
+	assert(t, "Out of range", true, err != nil)
+	_, err = u.InstantiateWith(map[string]string{"b-factor": "a"})
+	assert(t, "Bad factor", true, err != nil)
+}
+
+func Test_Ordering(t *testing.T) {
+	u, _, f := initial()
+	g := u.AddFactor("b-factor", "x", []string{"x", "y"})
+	labels := []string{"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7"}
+	for _, l := range labels {
+		u.AddTransition(l, state.FactorEquals{f, "a"}, state.Chosen{l}, "", map[*state.Factor]state.Value{f: "b"})
+	}
+
+	fs := u.Factors()
+	if assert(t, "Factor count", 2, len(fs)) {
+		assert(t, "First factor", f, fs[0])
+		assert(t, "Second factor", g, fs[1])
+	}
+	for run := 0; run < 3; run++ {
+		ts := u.Instantiate().ChosenTransitions()
+		if assert(t, "Choice count", len(labels), len(ts)) {
+			for i, tr := range ts {
+				assert(t, "Choice order", labels[i], tr.ChoiceDescription())
+			}
+		}
+	}
+}
+
+func Test_SpontaneousSeeded(t *testing.T) {
+	u, _, f := initial()
+	u.AddTransition("to-b", state.FactorEquals{f, "a"}, state.Spontaneous{1}, "", map[*state.Factor]state.Value{f: "b"})
+	u.AddTransition("to-c", state.FactorEquals{f, "a"}, state.Spontaneous{1}, "", map[*state.Factor]state.Value{f: "c"})
+
+	// Only one of the two can happen, depending on which goes first; the same
+	// seed must always pick the same one.
+	seen := map[state.Value]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		s1, s2 := u.Instantiate(), u.Instantiate()
+		s1.RunSpontaneous(rand.New(rand.NewSource(seed)))
+		s2.RunSpontaneous(rand.New(rand.NewSource(seed)))
+		assert(t, "Same seed, same result", s1.Get(f), s2.Get(f))
+		seen[s1.Get(f)] = true
+	}
+	assert(t, "Both orders happen", 2, len(seen))
+}
+
+func Test_SaveLoad(t *testing.T) {
+	u, _, f := initial()
+	gold := u.AddNumericFactor("gold", 0, 0, 10)
+	tr1 := u.AddTransition("transition1",
+		state.FactorEquals{f, "a"},
+		state.Chosen{"Go."},
+		"AB happened.",
+		map[*state.Factor]state.Value{f: "b"})
+	tr1.AddDelta(gold, 3)
+	tr2 := u.AddTransition("",
+		state.FactorEquals{f, "b"},
+		state.Chosen{"Go on."},
+		"BC happened.",
+		map[*state.Factor]state.Value{f: "c"})
+	s := u.Instantiate()
+	tr1.Apply(s)
+	tr2.Apply(s)
+	s.Goto(s.Now().Past())
+
+	rng := state.NewRNG(7)
+	rng.Float64()
+	rng.Perm(5)
+
+	var buf bytes.Buffer
+	if !assert(t, "Saved", nil, state.Save(&buf, s, rng)) {
+		return
+	}
+
+	// A copy of the same story can load it
+	u2, _, f2 := initial()
+	gold2 := u2.AddNumericFactor("gold", 0, 0, 10)
+	u2.AddTransition("transition1", state.FactorEquals{f2, "a"}, state.Chosen{"Go."}, "AB happened.", map[*state.Factor]state.Value{f2: "b"})
+	u2.AddTransition("", state.FactorEquals{f2, "b"}, state.Chosen{"Go on."}, "BC happened.", map[*state.Factor]state.Value{f2: "c"})
+	s2, rng2, err := state.Load(u2, bytes.NewReader(buf.Bytes()))
+	if !assert(t, "Loaded", nil, err) {
+		return
+	}
+	assert(t, "Current value", state.Value("b"), s2.Get(f2))
+	assert(t, "Current number", 3, s2.GetInt(gold2))
+	assert(t, "Cause", "AB happened.", s2.Now().Cause().Description())
+	assert(t, "Past", true, s2.Now().Past() != nil && s2.Now().Past().Cause() == nil)
+	if assert(t, "Future kept", true, s2.Now().Future() != nil) {
+		assert(t, "Unnamed cause", "BC happened.", s2.Now().Future().Cause().Description())
+	}
+	assert(t, "Seed", int64(7), rng2.Seed())
+	assert(t, "RNG continues", rng.Int63(), rng2.Int63())
+
+	// A different story can't
+	u3, _, _ := initial()
+	_, _, err = state.Load(u3, bytes.NewReader(buf.Bytes()))
+	assert(t, "Different story rejected", true, err != nil)
+}
+
+func Test_Branches(t *testing.T) {
+	u, _, f := initial()
+	toB := u.AddTransition("to-b", state.FactorEquals{f, "a"}, state.Chosen{"B"}, "", map[*state.Factor]state.Value{f: "b"})
+	toC := u.AddTransition("to-c", state.FactorEquals{f, "a"}, state.Chosen{"C"}, "", map[*state.Factor]state.Value{f: "c"})
+	s := u.Instantiate()
+	start := s.Now()
+	start.SetLabel("start")
+
+	toB.Apply(s)
+	b := s.Now()
+	b.SetLabel("went to b")
+	s.Goto(start)
+	toC.Apply(s)
+	c := s.Now()
+
+	branches := start.Branches()
+	if assert(t, "Two branches", 2, len(branches)) {
+		assert(t, "Old branch kept", b, branches[0])
+		assert(t, "New branch", c, branches[1])
+	}
+	assert(t, "Future is newest branch", c, start.Future())
+
+	s.Goto(s.FindLabel("went to b"))
+	assert(t, "Back on old branch", state.Value("b"), s.Get(f))
+	assert(t, "Future follows Goto", b, start.Future())
+	assert(t, "Find start", start, s.FindLabel("start"))
+	assert(t, "Find nothing", true, s.FindLabel("nowhere") == nil)
+
+	var buf bytes.Buffer
+	state.Save(&buf, s, nil)
+	s2, _, err := state.Load(u, &buf)
+	if assert(t, "Loaded", nil, err) {
+		start2 := s2.Beginning()
+		assert(t, "Loaded label", "start", start2.Label())
+		assert(t, "Loaded branches", 2, len(start2.Branches()))
+		assert(t, "Loaded now", "went to b", s2.Now().Label())
+		assert(t, "Loaded future", s2.Now(), start2.Future())
+	}
+}
+
+func Test_LastChoice(t *testing.T) {
+	u, r, f := initial()
+	u.AddTransition("to-b", state.FactorEquals{f, "a"}, state.Chosen{"B"}, "", map[*state.Factor]state.Value{f: "b"})
+	u.AddTransition("to-c", state.FactorEquals{f, "b"}, state.Spontaneous{1}, "", map[*state.Factor]state.Value{f: "c"})
+	s := u.Instantiate()
+	s.RunSpontaneous(r)
+	assert(t, "Nothing chosen", true, s.Now().LastChoice() == nil)
+	assert(t, "End of first turn", s.Now(), s.Beginning().EndOfTurn())
+
+	s.ChosenTransitions()[0].Apply(s)
+	chose := s.Now()
+	s.RunSpontaneous(r)
+	assert(t, "Last choice", chose, s.Now().LastChoice())
+	assert(t, "Choice is its own last choice", chose, chose.LastChoice())
+	assert(t, "End of turn", s.Now(), chose.EndOfTurn())
+	assert(t, "End of turn before choice", chose.Past(), s.Beginning().EndOfTurn())
+}
+
+func Test_Transcript(t *testing.T) {
+	u, r, f := initial()
+	u.AddTransition("to-b", state.FactorEquals{f, "a"}, state.Chosen{"B"}, "", map[*state.Factor]state.Value{f: "b"})
+	u.AddTransition("to-c", state.FactorEquals{f, "b"}, state.Spontaneous{1}, "Now c.", map[*state.Factor]state.Value{f: "c"})
+	u.AddEnding("done", state.FactorEquals{f, "c"}, "The end.")
+	s := u.Instantiate()
+	s.RunSpontaneous(r)
+	log := s.Now()
+	s.ChosenTransitions()[0].Apply(s)
+	s.RunSpontaneous(r)
+	assert(t, "Transcript skips what has no description", "Now c.|The end.", strings.Join(s.Transcript(log), "|"))
+	assert(t, "Nothing new", "The end.", strings.Join(s.Transcript(s.Now()), "|"))
+}
+
+func Test_SaveFile(t *testing.T) {
+	u, r, f := initial()
+	u.AddTransition("to-b", state.FactorEquals{f, "a"}, state.Chosen{"B"}, "", map[*state.Factor]state.Value{f: "b"})
+	s := u.Instantiate()
+	s.ChosenTransitions()[0].Apply(s)
+	s.RunSpontaneous(r)
+
+	name := filepath.Join(t.TempDir(), "game.json")
+	if !assert(t, "Saved", nil, state.SaveFile(name, s, nil)) {
+		return
+	}
+	s2, _, err := state.LoadFile(u, name)
+	if assert(t, "Loaded", nil, err) {
+		assert(t, "Loaded value", state.Value("b"), s2.Get(f))
+	}
+	_, _, err = state.LoadFile(u, filepath.Join(t.TempDir(), "missing.json"))
+	assert(t, "Missing file", true, os.IsNotExist(err))
+}
+
+func Test_Endings(t *testing.T) {
+	u, r, f := initial()
+	u.AddTransition("to-b", state.FactorEquals{f, "a"}, state.Chosen{"B"}, "", map[*state.Factor]state.Value{f: "b"})
+	u.AddTransition("to-c", state.FactorEquals{f, "b"}, state.Spontaneous{1}, "", map[*state.Factor]state.Value{f: "c"})
+	won := u.AddEnding("won", state.FactorEquals{f, "b"}, "You won.")
+	u.AddEnding("also-won", state.MkNot(state.FactorEquals{f, "a"}), "You won again.")
+	assert(t, "Valid", nil, u.Validate())
+	s := u.Instantiate()
+
+	assert(t, "Not ended", false, s.Ended())
+	assert(t, "No ending", true, s.Ending() == nil)
+	s.ChosenTransitions()[0].Apply(s)
+	assert(t, "Ended", true, s.Ended())
+	assert(t, "First ending wins", won, s.Ending())
+	assert(t, "Nothing possible", 0, len(s.PossibleTransitions()))
+	s.RunSpontaneous(r)
+	assert(t, "Nothing happens", state.Value("b"), s.Get(f))
+
+	// Back past the end of the turn and the choice
+	s.Goto(s.Now().Past().Past())
+	assert(t, "Undone", false, s.Ended())
+
+	u.AddEnding("won", state.FactorEquals{f, "z"}, "")
+	assert(t, "Invalid", "ending won: declared more than once\nending won: condition compares a-factor to unknown value z", u.Validate().Error())
+}
+
+func Test_ConditionString(t *testing.T) {
+	u, _, f := initial()
+	n := u.AddNumericFactor("n", 0, 0, 5)
+	a, b := state.FactorEquals{f, "a"}, state.FactorEquals{f, "b"}
+	assert(t, "Equals", "a-factor = a", a.String())
+	assert(t, "Not equals", "a-factor != a", state.MkNot(a).String())
+	assert(t, "Compare", "n <= 3", state.Compare{n, state.LessEq, 3}.String())
+	assert(t, "Or in And", "(a-factor = a | a-factor = b) & n > 0",
+		state.MkAnd(state.MkOr(a, b), state.Compare{n, state.Greater, 0}).String())
+	assert(t, "And in Or", "(a-factor = a & n < 5) | a-factor = b",
+		state.MkOr(state.MkAnd(a, state.Compare{n, state.Less, 5}), b).String())
+	assert(t, "Single clauses", "a-factor = a | a-factor = b", state.MkAnd(state.MkOr(state.MkAnd(a), b)).String())
+	assert(t, "Not compound", "not (a-factor = a | a-factor = b)", state.MkNot(state.MkOr(a, b)).String())
+}
+
+func Test_Export(t *testing.T) {
+	u, _, f := initial()
+	n := u.AddNumericFactor("n", 1, 0, 5)
+	tr := u.AddTransition("to-b", state.MkAnd(state.FactorEquals{f, "a"}, state.FactorEquals{f, "a"}), state.Chosen{"B & more"}, "", map[*state.Factor]state.Value{f: "b"})
+	tr.AddDelta(n, 2)
+	u.AddTransition("", state.FactorEquals{f, "b"}, state.Spontaneous{0.5}, "Whee.", map[*state.Factor]state.Value{})
+	u.AddEnding("end", state.FactorEquals{f, "c"}, "The end.")
+	var buf bytes.Buffer
+	if !assert(t, "Exported", nil, u.Export(&buf)) {
+		return
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`"values": [`,
+		`"min": 0,`,
+		`"max": 5,`,
+		`"initial": "1"`,
+		`"condition": "a-factor = a & a-factor = a",`,
+		`"choice": "B & more",`,
+		`"probability": 0.5,`,
+		`"n": 2`,
+		`"text": "The end."`,
+	} {
+		assert(t, "Contains "+want, true, strings.Contains(out, want))
+	}
+}
+
+func Test_WriteDot(t *testing.T) {
+	u, _, f := initial()
+	u.AddTransition("to-b", state.FactorEquals{f, "a"}, state.Chosen{"B"}, "", map[*state.Factor]state.Value{f: "b"})
+	u.AddTransition("to-c", state.Not{state.FactorEquals{f, "c"}}, state.Spontaneous{0.5}, "", map[*state.Factor]state.Value{f: "c"})
+	u.AddTransition("to-a", state.FactorEquals{f, "c"}, state.Chosen{"{if a-factor = c}Back{else}On{/if} from {a-factor}."}, "", map[*state.Factor]state.Value{f: "a"}).
+		SetChoiceTemplate(state.Template{
+			state.TemplateIf{state.FactorEquals{f, "c"}, state.Template{state.TemplateText("Back")}, state.Template{state.TemplateText("On")}},
+			state.TemplateText(" from "), state.TemplateValue{f}, state.TemplateText("."),
+		})
+	var buf bytes.Buffer
+	if !assert(t, "Written", nil, u.WriteDot(&buf)) {
+		return
+	}
+	dot := buf.String()
+	assert(t, "Initial value", true, strings.Contains(dot, `"a-factor:a" [label="a", style=bold];`))
+	assert(t, "Chosen edge", true, strings.Contains(dot, `"a-factor:a" -> "a-factor:b" [label="to-b\nB"];`))
+	assert(t, "Spontaneous edge", true, strings.Contains(dot, `"a-factor:*" -> "a-factor:c" [label="to-c (0.5)", style=dashed];`))
+	assert(t, "Template outlined", true, strings.Contains(dot, `"a-factor:c" -> "a-factor:a" [label="to-a\nBack/On from <a-factor>."];`))
+}
+
 // TODO: test AddFactor once there's a good way to inspect it
 // TODO: test AddTransition once there's a good way to inspect it
 // TODO: test Instantiate initial contents once there's a good way to inspect it
 // TODO: test possible-transition calculation
+
+func Test_Templates(t *testing.T) {
+	u, _, f := initial()
+	tmpl := state.Template{
+		state.TemplateText("It is "),
+		state.TemplateValue{f},
+		state.TemplateIf{state.FactorEquals{f, "b"}, state.Template{state.TemplateText(", at last")}, nil},
+		state.TemplateText("."),
+	}
+	go_ := u.AddTransition("go", state.FactorEquals{f, "a"}, state.Chosen{"Go from {a-factor}."}, "Now {a-factor}.", map[*state.Factor]state.Value{f: "b"})
+	go_.SetTemplate(tmpl)
+	go_.SetChoiceTemplate(state.Template{state.TemplateText("Go from "), state.TemplateValue{f}, state.TemplateText(".")})
+	u.AddDescription(state.FactorEquals{f, "b"}, "").SetTemplate(state.Template{state.TemplateValue{f}})
+	u.AddEnding("done", state.FactorEquals{f, "b"}, "").SetTemplate(tmpl)
+
+	s := u.Instantiate()
+	assert(t, "Filled in", "It is a.", tmpl.Fill(s))
+	assert(t, "Choice filled in", "Go from a.", go_.Choice(s))
+	assert(t, "Raw description kept", "Now {a-factor}.", go_.Description())
+	go_.Apply(s)
+	assert(t, "Description filled in after", "It is b, at last.", s.Now().Description())
+	assert(t, "Choice as it was made", "Go from a.", s.Now().Choice())
+	if ds := s.Descriptions(); assert(t, "Description shown", 1, len(ds)) {
+		assert(t, "Description filled in", "b", ds[0])
+	}
+	assert(t, "Ending filled in", "It is b, at last.", s.EndingText())
+}
+
+func Test_Timed(t *testing.T) {
+	u, r, f := initial()
+	guard := u.AddFactor("guard", "here", []string{"here", "gone"})
+	bell := u.AddNumericFactor("bell", 0, 0, 10)
+	clock := u.AddNumericFactor("clock", 0, 0, 10)
+	u.AddTransition("leave",
+		state.FactorEquals{guard, "here"},
+		state.Chosen{"Distract the guard."},
+		"",
+		map[*state.Factor]state.Value{guard: "gone"})
+	u.AddTransition("return",
+		state.FactorEquals{guard, "gone"},
+		state.After{3},
+		"The guard comes back.",
+		map[*state.Factor]state.Value{guard: "here"})
+	u.AddTransition("ring",
+		state.FactorEquals{f, "a"},
+		state.Every{2},
+		"",
+		map[*state.Factor]state.Value{}).AddDelta(bell, 1)
+	u.AddTransition("noon",
+		state.FactorEquals{f, "a"},
+		state.AtTurn{4},
+		"",
+		map[*state.Factor]state.Value{}).AddDelta(clock, 1)
+	s := u.Instantiate()
+
+	s.RunSpontaneous(r)
+	assert(t, "Turn after starting", 1, s.Turn())
+	s.ChosenTransitions()[0].Apply(s)
+	var guards []string
+	for i := 0; i < 5; i++ {
+		s.RunSpontaneous(r)
+		guards = append(guards, string(s.Get(guard)))
+	}
+	assert(t, "Turn", 6, s.Turn())
+	assert(t, "Guard comes back after 3 turns", "gone gone gone here here", strings.Join(guards, " "))
+	assert(t, "Bell rings every 2 turns", 2, s.GetInt(bell))
+	assert(t, "Clock strikes once", 1, s.GetInt(clock))
+
+	// Undoing goes back to the turn the choice was made in
+	m := s.Now()
+	for m.Cause() == nil || !m.Cause().IsChoice() {
+		m = m.Past()
+	}
+	s.Goto(m.Past())
+	assert(t, "Turn after undoing", 1, s.Turn())
+
+	// Waiting again from there doesn't change the history
+	s.Goto(m)
+	assert(t, "Turn after going back", 1, s.Turn())
+	s.RunSpontaneous(r)
+	assert(t, "Turn after waiting again", 2, s.Turn())
+	assert(t, "Waiting again branches", 2, len(m.Branches()))
+	s.Goto(m)
+	assert(t, "Turn after going back again", 1, s.Turn())
+
+	// Turns are saved along with everything else
+	var buf bytes.Buffer
+	s.RunSpontaneous(r)
+	if !assert(t, "Saved", nil, state.Save(&buf, s, nil)) {
+		return
+	}
+	s2, _, err := state.Load(u, &buf)
+	if !assert(t, "Loaded", nil, err) {
+		return
+	}
+	assert(t, "Loaded turn", 2, s2.Turn())
+	s2.RunSpontaneous(r)
+	s2.RunSpontaneous(r)
+	assert(t, "Loaded game keeps waiting", state.Value("gone"), s2.Get(guard))
+	s2.RunSpontaneous(r)
+	assert(t, "Loaded game carries on", state.Value("here"), s2.Get(guard))
+}
+
+func Test_ValidateTimed(t *testing.T) {
+	u, _, f := initial()
+	for _, sc := range []state.Schedule{state.After{0}, state.Every{-1}, state.AtTurn{-2}, state.AtTurn{0}} {
+		u.AddTransition("", state.FactorEquals{f, "a"}, sc, "", map[*state.Factor]state.Value{f: "b"})
+	}
+	errs, _ := u.Validate().(state.ValidationErrors)
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	assert(t, "Problems", strings.Join([]string{
+		"unnamed transition: waits 0 turns, but has to wait at least 1",
+		"unnamed transition: happens every -1 turns, but has to wait at least 1",
+		"unnamed transition: happens at turn -2, before the story begins",
+	}, "\n"), strings.Join(got, "\n"))
+}
+
+func Test_Outcomes(t *testing.T) {
+	u, _, f := initial()
+	tries := u.AddNumericFactor("tries", 0, 0, 10)
+	tr := u.AddTransition("try",
+		state.FactorEquals{f, "a"},
+		state.Chosen{"Try."},
+		"You try.",
+		map[*state.Factor]state.Value{})
+	tr.AddDelta(tries, 1)
+	works := tr.AddOutcome(3, "It works.", map[*state.Factor]state.Value{f: "b"})
+	fails := tr.AddOutcome(1, "", map[*state.Factor]state.Value{f: "c"})
+	fails.AddDelta(tries, 1)
+	assert(t, "Chance", 0.75, tr.Chance(works))
+	assert(t, "Valid", nil, u.Validate())
+
+	s := u.Instantiate()
+	tr.ApplyOutcome(s, fails)
+	assert(t, "Outcome's effect", state.Value("c"), s.Get(f))
+	assert(t, "Both deltas", 2, s.GetInt(tries))
+	assert(t, "Outcome recorded", fails, s.Now().Outcome())
+	assert(t, "Transition's text without the outcome's", "You try.", s.Now().Description())
+
+	// Picking is random, but in proportion to the weights
+	picked := map[*state.Outcome]int{}
+	s.SetRand(rand.New(rand.NewSource(1)))
+	for i := 0; i < 1000; i++ {
+		s.Goto(s.Beginning())
+		tr.Apply(s)
+		picked[s.Now().Outcome()]++
+	}
+	assert(t, "Mostly works", true, picked[works] > 650 && picked[works] < 850)
+	assert(t, "Only outcomes picked", 1000, picked[works]+picked[fails])
+
+	// Outcomes are saved along with everything else
+	s.Goto(s.Beginning())
+	tr.ApplyOutcome(s, works)
+	assert(t, "Outcome's text", "It works.", s.Now().Description())
+	var buf bytes.Buffer
+	if !assert(t, "Saved", nil, state.Save(&buf, s, nil)) {
+		return
+	}
+	s2, _, err := state.Load(u, &buf)
+	if assert(t, "Loaded", nil, err) {
+		assert(t, "Loaded outcome", works, s2.Now().Outcome())
+	}
+
+	// A story whose transition has a different number of outcomes can't load it
+	u2, _, f2 := initial()
+	u2.AddNumericFactor("tries", 0, 0, 10)
+	u2.AddTransition("try", state.FactorEquals{f2, "a"}, state.Chosen{"Try."}, "You try.", map[*state.Factor]state.Value{})
+	assert(t, "Different outcomes, different story", false, u.Fingerprint() == u2.Fingerprint())
+}
+
+func Test_Exclusive(t *testing.T) {
+	u, _, f := initial()
+	calls := u.AddNumericFactor("calls", 0, 0, 10)
+	phone := u.AddTransition("phone",
+		state.FactorEquals{f, "a"},
+		state.Spontaneous{1},
+		"The phone rings.",
+		map[*state.Factor]state.Value{})
+	phone.AddDelta(calls, 1)
+	busy := u.AddTransition("busy",
+		state.FactorEquals{f, "a"},
+		state.Spontaneous{1},
+		"She's busy.",
+		map[*state.Factor]state.Value{f: "b"})
+	busy.SetPriority(1)
+	u.AddExclusive("jeanna", []*state.Transition{phone, busy})
+
+	// Whatever the shuffle, the higher priority transition goes first and
+	// keeps the other from happening
+	for seed := int64(0); seed < 20; seed++ {
+		s := u.Instantiate()
+		s.RunSpontaneous(rand.New(rand.NewSource(seed)))
+		if !assert(t, "Only the higher priority happened", busy, s.Now().Cause()) ||
+			!assert(t, "Nothing else happened", true, s.Now().Past().Cause() == nil) {
+			return
+		}
+	}
+
+	// Another turn, and the other can have its go
+	busy.SetPriority(0)
+	phone.SetPriority(2)
+	s := u.Instantiate()
+	s.RunSpontaneous(rand.New(rand.NewSource(0)))
+	s.RunSpontaneous(rand.New(rand.NewSource(0)))
+	assert(t, "One a turn", 2, s.GetInt(calls))
+}
+
+func Test_Settle(t *testing.T) {
+	u, r, f := initial()
+	u.AddTransition("ab", state.FactorEquals{f, "a"}, state.Spontaneous{1}, "", map[*state.Factor]state.Value{f: "b"})
+	u.AddTransition("bc", state.FactorEquals{f, "b"}, state.Spontaneous{1}, "", map[*state.Factor]state.Value{f: "c"})
+	u.AddTransition("ca", state.FactorEquals{f, "c"}, state.Spontaneous{1}, "", map[*state.Factor]state.Value{f: "a"})
+
+	s := u.Instantiate()
+	s.RunSpontaneous(r)
+	assert(t, "One step without settling", state.Value("b"), s.Get(f))
+
+	u.SetSettle(true)
+	s = u.Instantiate()
+	s.RunSpontaneous(r)
+	assert(t, "Settled, each transition happening once", state.Value("a"), s.Get(f))
+	var causes []string
+	for m := s.Now(); m.Cause() != nil; m = m.Past() {
+		causes = append([]string{m.Cause().Label()}, causes...)
+	}
+	assert(t, "In order", "ab bc ca", strings.Join(causes, " "))
+}
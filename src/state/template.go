@@ -0,0 +1,204 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Text that changes with the story.  A Template is filled in from a State
+	when it's shown: {sun} shows the value of sun, and
+	{if sun = night}dark{else}bright{/if} shows one piece of text or the
+	other.  The parser turns text written that way into Templates.
+*/
+
+package state
+
+import (
+	"strings"
+)
+
+// A Template is text with parts that depend on the State it's shown in.
+type Template []TemplatePart
+
+// A TemplatePart is a TemplateText, a TemplateValue or a TemplateIf.
+type TemplatePart interface {
+	fill(s *State, out *strings.Builder)
+	outline(out *strings.Builder)
+}
+
+// Text shown as it is.
+type TemplateText string
+
+// The value of a factor.
+type TemplateValue struct {
+	Factor *Factor
+}
+
+// Then if the condition holds, otherwise Else.
+type TemplateIf struct {
+	Condition BoolExpr
+	Then      Template
+	Else      Template
+}
+
+// Fills in t from s.
+func (t Template) Fill(s *State) string {
+	var out strings.Builder
+	t.fillInto(s, &out)
+	return out.String()
+}
+
+func (t Template) fillInto(s *State, out *strings.Builder) {
+	for _, part := range t {
+		part.fill(s, out)
+	}
+}
+
+func (t TemplateText) fill(s *State, out *strings.Builder) {
+	out.WriteString(string(t))
+}
+
+func (t TemplateValue) fill(s *State, out *strings.Builder) {
+	out.WriteString(string(s.Get(t.Factor)))
+}
+
+func (t TemplateIf) fill(s *State, out *strings.Builder) {
+	if t.Condition.Evaluate(s) {
+		t.Then.fillInto(s, out)
+	} else {
+		t.Else.fillInto(s, out)
+	}
+}
+
+// Writes t without a State to fill it in from, for showing the story's
+// structure: each factor's value shows as <factor>, and both pieces of text of
+// an if show, separated by a /.
+func (t Template) outlineInto(out *strings.Builder) {
+	for _, part := range t {
+		part.outline(out)
+	}
+}
+
+func (t TemplateText) outline(out *strings.Builder) {
+	out.WriteString(string(t))
+}
+
+func (t TemplateValue) outline(out *strings.Builder) {
+	out.WriteString("<" + t.Factor.label + ">")
+}
+
+func (t TemplateIf) outline(out *strings.Builder) {
+	t.Then.outlineInto(out)
+	if len(t.Else) > 0 {
+		out.WriteString("/")
+		t.Else.outlineInto(out)
+	}
+}
+
+// Fills in tmpl from s, or if there's no template, gives the plain text.
+func fill(tmpl Template, text string, s *State) string {
+	if tmpl == nil {
+		return text
+	}
+	return tmpl.Fill(s)
+}
+
+// Has the description of a Transition filled in from the State it leads to.
+func (t *Transition) SetTemplate(tmpl Template) {
+	t.template = tmpl
+}
+
+// Has the text of a Transition's choice filled in from the State it's
+// offered in.
+func (t *Transition) SetChoiceTemplate(tmpl Template) {
+	t.choiceTemplate = tmpl
+}
+
+func (d *Description) SetTemplate(tmpl Template) {
+	d.template = tmpl
+}
+
+func (e *Ending) SetTemplate(tmpl Template) {
+	e.template = tmpl
+}
+
+// The description of the Transition that led to m, filled in from m, so that
+// it shows things as they are once the Transition has happened.  If it turned
+// out one of several ways, that outcome's description is used instead, unless
+// it doesn't have one.
+func (m *Moment) Description() string {
+	if m.cause == nil {
+		return ""
+	}
+	s := &State{universe: m.universe, now: m}
+	if m.outcome != nil && m.outcome.description != "" {
+		return fill(m.outcome.template, m.outcome.description, s)
+	}
+	return fill(m.cause.template, m.cause.description, s)
+}
+
+// The text of the choice that led to m, filled in from the Moment before, as
+// it was when the choice was made.  "" if nothing led to m.
+func (m *Moment) Choice() string {
+	if m.cause == nil || m.past == nil {
+		return ""
+	}
+	return m.cause.Choice(&State{universe: m.universe, now: m.past})
+}
+
+// The text of t's choice, filled in from s.
+func (t *Transition) Choice(s *State) string {
+	return fill(t.choiceTemplate, t.schedule.ChoiceDescription(), s)
+}
+
+// The text of t's choice, outlined rather than filled in, for when there's no
+// State to fill it in from.
+func (t *Transition) choiceOutline() string {
+	if t.choiceTemplate == nil {
+		return t.schedule.ChoiceDescription()
+	}
+	var out strings.Builder
+	t.choiceTemplate.outlineInto(&out)
+	return out.String()
+}
+
+// The text of the Ending s has reached, filled in from s, or "" if it hasn't
+// reached one.
+func (s *State) EndingText() string {
+	e := s.Ending()
+	if e == nil {
+		return ""
+	}
+	return fill(e.template, e.text, s)
+}
+
+// Everything shown to the player since the Moment log, which must lead to
+// where s is now: the descriptions of what has happened, then how things are
+// now, and the ending if the story is over.
+func (s *State) Transcript(log *Moment) []string {
+	var lines []string
+	for log != s.now {
+		log = log.future
+		if text := log.Description(); text != "" {
+			lines = append(lines, text)
+		}
+	}
+	lines = append(lines, s.Descriptions()...)
+	if s.Ended() {
+		lines = append(lines, s.EndingText())
+	}
+	return lines
+}
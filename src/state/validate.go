@@ -0,0 +1,330 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Story-wide sanity checks.  The state machine will happily run a Universe
+	with typos in it, so this looks for the kinds of mistakes that would
+	otherwise only show up as a transition that mysteriously never happens.
+*/
+
+package state
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A ValidationError is one problem with a Universe.  What names the factor or
+// transition at fault, and Subject is the Factor, Transition, Description or
+// Ending itself.  Warnings are for things that are probably mistakes, but
+// that the story will still run with.
+//
+// Pos is where Subject was declared, if known.  Validate can't know that, so
+// it is left for whatever read the story to fill in.
+type ValidationError struct {
+	What    string
+	Problem string
+	Warning bool
+	Subject interface{}
+	Pos     string
+}
+
+func (e *ValidationError) Error() string {
+	msg := e.What + ": " + e.Problem
+	if e.Warning {
+		msg = "warning: " + msg
+	}
+	if e.Pos != "" {
+		msg = e.Pos + ": " + msg
+	}
+	return msg
+}
+
+// ValidationErrors is everything Validate found wrong.
+type ValidationErrors []*ValidationError
+
+// Whether any of the problems are worse than warnings.
+func (l ValidationErrors) Fatal() bool {
+	for _, e := range l {
+		if !e.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+func (l ValidationErrors) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Checks the whole Universe for mistakes: factors or values that don't
+// exist, labels used twice, factors with no values, and timed transitions
+// that don't wait a whole turn.  Transitions that wouldn't change anything
+// are only warned about, as they can still be used for narration, and so are
+// priorities and exclusive groups that make no difference.  Returns nil if
+// it's all fine, otherwise a ValidationErrors listing every problem.
+func (u *Universe) Validate() error {
+	var errs ValidationErrors
+	var subject interface{}
+	problem := func(what string, problem string) {
+		errs = append(errs, &ValidationError{What: what, Problem: problem, Subject: subject})
+	}
+
+	for _, f := range u.duplicates {
+		subject = f
+		problem("factor "+f.label, "declared more than once")
+	}
+
+	for _, f := range u.factorOrder {
+		subject = f
+		what := "factor " + f.label
+		if f.numeric && f.min > f.max {
+			problem(what, "range "+strconv.Itoa(f.min)+":"+strconv.Itoa(f.max)+" is empty")
+		} else if !f.numeric && len(f.possible) == 0 {
+			problem(what, "has no values")
+		} else if !f.Possible(f.initial) {
+			problem(what, "initial value "+string(f.initial)+" is not one of its values")
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, t := range u.transitions {
+		subject = t
+		what := "transition " + t.label
+		if t.label == "" {
+			what = "unnamed transition"
+		} else if seen[t.label] {
+			problem(what, "declared more than once")
+		}
+		seen[t.label] = true
+
+		if t.condition == nil {
+			problem(what, "has no condition")
+		} else {
+			u.checkExpr(t.condition, func(p string) { problem(what, p) })
+		}
+		u.checkTemplate(t.template, func(p string) { problem(what, p) })
+		u.checkTemplate(t.choiceTemplate, func(p string) { problem(what, p) })
+		switch sc := t.schedule.(type) {
+		case After:
+			if sc.Turns < 1 {
+				problem(what, "waits "+strconv.Itoa(sc.Turns)+" turns, but has to wait at least 1")
+			}
+		case Every:
+			if sc.Turns < 1 {
+				problem(what, "happens every "+strconv.Itoa(sc.Turns)+" turns, but has to wait at least 1")
+			}
+		case AtTurn:
+			if sc.Turn < 0 {
+				problem(what, "happens at turn "+strconv.Itoa(sc.Turn)+", before the story begins")
+			}
+		}
+
+		u.checkEffects(t.effects, t.deltas, func(p string) { problem(what, p) })
+		for i, o := range t.outcomes {
+			n := strconv.Itoa(i + 1)
+			if o.weight <= 0 {
+				problem(what, "outcome "+n+" has weight "+strconv.FormatFloat(o.weight, 'g', -1, 64)+", so it can never happen")
+			}
+			u.checkEffects(o.effects, o.deltas, func(p string) { problem(what, "outcome "+n+": "+p) })
+			u.checkTemplate(o.template, func(p string) { problem(what, "outcome "+n+": "+p) })
+		}
+		if t.isNoOp() {
+			errs = append(errs, &ValidationError{What: what, Problem: "effects never change anything", Warning: true, Subject: t})
+		}
+		if t.priority != 0 && t.schedule.ask() {
+			errs = append(errs, &ValidationError{What: what, Problem: "priority makes no difference to a choice", Warning: true, Subject: t})
+		}
+	}
+
+	for _, g := range u.exclusives {
+		what := "exclusive " + g.label
+		if g.label == "" {
+			what = "unnamed exclusive group"
+		}
+		warn := func(problem string) {
+			errs = append(errs, &ValidationError{What: what, Problem: problem, Warning: true, Subject: g})
+		}
+		if len(g.transitions) < 2 {
+			warn("has fewer than two transitions, so it makes no difference")
+		}
+		for _, t := range g.transitions {
+			if t.schedule.ask() {
+				warn("makes no difference to choice " + t.label)
+			}
+		}
+	}
+
+	for _, d := range u.descriptions {
+		subject = d
+		what := "description " + strconv.Quote(abbreviate(d.text))
+		u.checkExpr(d.condition, func(p string) { problem(what, p) })
+		u.checkTemplate(d.template, func(p string) { problem(what, p) })
+	}
+
+	seen = map[string]bool{}
+	for _, e := range u.endings {
+		subject = e
+		what := "ending " + e.label
+		if seen[e.label] {
+			problem(what, "declared more than once")
+		}
+		seen[e.label] = true
+		if e.condition == nil {
+			problem(what, "has no condition")
+		} else {
+			u.checkExpr(e.condition, func(p string) { problem(what, p) })
+		}
+		u.checkTemplate(e.template, func(p string) { problem(what, p) })
+	}
+
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+// Reports problems with the factors and values a transition's effects refer
+// to.
+func (u *Universe) checkEffects(effects map[*Factor]Value, deltas map[*Factor]int, problem func(string)) {
+	for f, v := range effects {
+		if !u.owns(f) {
+			problem("effect changes an undeclared factor")
+		} else if !f.Possible(v) {
+			problem("effect sets " + f.label + " to unknown value " + string(v))
+		}
+	}
+	for f, _ := range deltas {
+		if !u.owns(f) {
+			problem("effect changes an undeclared factor")
+		} else if !f.numeric {
+			problem("effect does arithmetic on non-numeric factor " + f.label)
+		}
+	}
+}
+
+// Whether f is a Factor of this Universe (and not nil, or from another one).
+func (u *Universe) owns(f *Factor) bool {
+	return f != nil && u.factors[f.label] == f
+}
+
+// Reports problems with the factors and values an expression refers to.
+func (u *Universe) checkExpr(e BoolExpr, problem func(string)) {
+	switch e := e.(type) {
+	case FactorEquals:
+		if !u.owns(e.Factor) {
+			problem("condition refers to an undeclared factor")
+		} else if !e.Factor.Possible(e.Value) {
+			problem("condition compares " + e.Factor.label + " to unknown value " + string(e.Value))
+		}
+	case Compare:
+		if !u.owns(e.Factor) {
+			problem("condition refers to an undeclared factor")
+		} else if !e.Factor.numeric {
+			problem("condition uses " + e.Op.String() + " on non-numeric factor " + e.Factor.label)
+		}
+	case Not:
+		u.checkExpr(e.Clause, problem)
+	case And:
+		for _, c := range e.Clauses {
+			u.checkExpr(c, problem)
+		}
+	case Or:
+		for _, c := range e.Clauses {
+			u.checkExpr(c, problem)
+		}
+	}
+}
+
+// Reports problems with the factors a Template shows or asks about.
+func (u *Universe) checkTemplate(t Template, problem func(string)) {
+	for _, part := range t {
+		switch part := part.(type) {
+		case TemplateValue:
+			if !u.owns(part.Factor) {
+				problem("text shows an undeclared factor")
+			}
+		case TemplateIf:
+			u.checkExpr(part.Condition, problem)
+			u.checkTemplate(part.Then, problem)
+			u.checkTemplate(part.Else, problem)
+		}
+	}
+}
+
+// A transition is a no-op if it has no effects, or if its condition already
+// guarantees every factor it (or any of its outcomes) sets has the value it
+// would be set to.
+func (t *Transition) isNoOp() bool {
+	pinned := map[*Factor]Value{}
+	if t.condition != nil {
+		pins(t.condition, pinned)
+	}
+	if !unchanged(pinned, t.effects, t.deltas) {
+		return false
+	}
+	for _, o := range t.outcomes {
+		if !unchanged(pinned, o.effects, o.deltas) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether effects and deltas leave the pinned values as they are.
+func unchanged(pinned map[*Factor]Value, effects map[*Factor]Value, deltas map[*Factor]int) bool {
+	for f, v := range effects {
+		if pv, ok := pinned[f]; !ok || pv != v {
+			return false
+		}
+	}
+	for _, n := range deltas {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Fills in the factor values that e can only be true with.
+func pins(e BoolExpr, pinned map[*Factor]Value) {
+	switch e := e.(type) {
+	case FactorEquals:
+		pinned[e.Factor] = e.Value
+	case And:
+		for _, c := range e.Clauses {
+			pins(c, pinned)
+		}
+	case Or:
+		if len(e.Clauses) == 1 {
+			pins(e.Clauses[0], pinned)
+		}
+	}
+}
+
+// Shortens long text to something that fits in an error message.
+func abbreviate(text string) string {
+	if r := []rune(text); len(r) > 24 {
+		return string(r[:21]) + "..."
+	}
+	return text
+}
@@ -0,0 +1,314 @@
+/*
+    This file is part of Plotomaton.
+
+    Plotomaton is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Plotomaton is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Plotomaton.  If not, see <http://www.gnu.org/licenses/>.
+
+    Author - Sean Anderson
+    Contact: fnordit@gmail.com
+
+	Story tests.  A test file plays through a story, checking as it goes
+	that things turn out the way they should:
+
+		% Comments start with %, as in stories
+		story "office.plot"
+		seed 42
+		choose "Leave room."
+		expect location = Hallway
+		wait
+		expect text "The sun sets."
+		choose ToOfficeDay
+		expect ending good
+
+	choose takes a choice's text or its transition's label, and wait lets a
+	turn go by without choosing anything.  expect checks a condition, written
+	the same way as in the story; expect text checks for a line shown since
+	the last choice; and expect ending checks which ending has been reached.
+
+	story names the story, relative to the test file; by default, foo.test
+	tests foo.  seed sets the random seed, which is 0 by default.  Both have
+	to come before any of the steps.
+*/
+
+package storytest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"parser"
+	"path/filepath"
+	"state"
+	"strconv"
+	"strings"
+)
+
+// A Test is a story test file, read but not yet run.
+type Test struct {
+	Name  string
+	Story string
+	Seed  int64
+	Steps []*Step
+}
+
+// A Step is one line of a test, other than its story and seed.
+type Step struct {
+	Line int
+	Text string
+
+	kind string
+	arg  string
+}
+
+// The Result of running one Step.  If it failed, Diff says how what happened
+// differed from what the Step expected.
+type Result struct {
+	Step   *Step
+	Passed bool
+	Diff   string
+}
+
+// Reads the test file with the given name.
+func ParseFile(name string) (*Test, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t, err := Parse(f, name)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(t.Story) {
+		t.Story = filepath.Join(filepath.Dir(name), t.Story)
+	}
+	return t, nil
+}
+
+// Reads a test from r.  The name is used in error messages, and to find the
+// story if the test doesn't name it.
+func Parse(r io.Reader, name string) (*Test, error) {
+	t := &Test{Name: name, Story: filepath.Base(strings.TrimSuffix(name, ".test"))}
+	in := bufio.NewScanner(r)
+	for line := 1; in.Scan(); line++ {
+		text := strings.TrimSpace(in.Text())
+		if text == "" || strings.HasPrefix(text, "%") {
+			continue
+		}
+		bad := func(problem string) error {
+			return fmt.Errorf("%s:%d: %s", name, line, problem)
+		}
+
+		kind, arg := text, ""
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			kind, arg = text[:i], strings.TrimSpace(text[i+1:])
+		}
+		switch kind {
+		case "story", "seed":
+			if len(t.Steps) > 0 {
+				return nil, bad(kind + " has to come before the first step")
+			}
+			if kind == "story" {
+				story, err := strconv.Unquote(arg)
+				if err != nil {
+					return nil, bad("story needs a quoted file name")
+				}
+				t.Story = story
+			} else {
+				seed, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil {
+					return nil, bad("seed needs a number")
+				}
+				t.Seed = seed
+			}
+			continue
+		case "choose":
+			if strings.HasPrefix(arg, "\"") {
+				choice, err := strconv.Unquote(arg)
+				if err != nil {
+					return nil, bad("badly quoted choice")
+				}
+				arg = choice
+			}
+			if arg == "" {
+				return nil, bad("choose needs a choice")
+			}
+		case "wait":
+			if arg != "" {
+				return nil, bad("wait doesn't take anything after it")
+			}
+		case "expect":
+			switch {
+			case strings.HasPrefix(arg, "text "):
+				expected, err := strconv.Unquote(strings.TrimSpace(arg[5:]))
+				if err != nil {
+					return nil, bad("expect text needs quoted text")
+				}
+				kind, arg = "text", expected
+			case strings.HasPrefix(arg, "ending "):
+				kind, arg = "ending", strings.TrimSpace(arg[7:])
+			case arg == "":
+				return nil, bad("expect needs a condition, text or ending")
+			}
+		default:
+			return nil, bad("expected 'story', 'seed', 'choose', 'wait' or 'expect', found " + strconv.Quote(kind))
+		}
+		t.Steps = append(t.Steps, &Step{line, text, kind, arg})
+	}
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Runs the test against its story, which is read from t.Story.
+func (t *Test) Run() ([]Result, error) {
+	u, err := parser.ParseFile(t.Story)
+	if u == nil {
+		return nil, err
+	}
+	return t.RunUniverse(u), nil
+}
+
+// Runs the test against u, from its initial State.  Every Step is run, even
+// after one fails, so that every problem shows up at once.  Once a choice
+// can't be made, though, the Steps after it can't mean anything, and fail
+// without being tried.
+func (t *Test) RunUniverse(u *state.Universe) []Result {
+	s := u.Instantiate()
+	r := state.NewRNG(t.Seed)
+	s.SetRand(r.Rand)
+	s.RunSpontaneous(r.Rand)
+	shown, log := s.Transcript(s.Beginning()), s.Now()
+
+	var results []Result
+	var stuck error
+	for _, step := range t.Steps {
+		res := Result{Step: step}
+		var err error
+		switch {
+		case stuck != nil:
+			err = stuck
+		case step.kind == "choose" || step.kind == "wait":
+			err = choose(s, step)
+			if err != nil {
+				stuck = errors.New("not run, as an earlier choice couldn't be made")
+				break
+			}
+			s.RunSpontaneous(r.Rand)
+			shown, log = s.Transcript(log), s.Now()
+		case step.kind == "text":
+			err = expectText(shown, step.arg)
+		case step.kind == "ending":
+			err = expectEnding(s, step.arg)
+		default:
+			err = expect(u, s, step.arg)
+		}
+		res.Passed = err == nil
+		if err != nil {
+			res.Diff = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func choose(s *state.State, step *Step) error {
+	if s.Ended() {
+		return errors.New("the story has already ended")
+	}
+	if step.kind == "wait" {
+		return nil
+	}
+	if t := s.FindChoice(step.arg); t != nil {
+		t.Apply(s)
+		return nil
+	}
+	var available []string
+	for _, t := range s.ChosenTransitions() {
+		available = append(available, "+ "+t.Choice(s))
+	}
+	return errors.New(strings.Join(append([]string{"- " + step.arg}, available...), "\n"))
+}
+
+func expectText(shown []string, text string) error {
+	for _, line := range shown {
+		if line == text {
+			return nil
+		}
+	}
+	diff := []string{"- " + text}
+	for _, line := range shown {
+		diff = append(diff, "+ "+line)
+	}
+	return errors.New(strings.Join(diff, "\n"))
+}
+
+func expectEnding(s *state.State, label string) error {
+	got := "(no ending)"
+	if ending := s.Ending(); ending != nil {
+		if ending.Label() == label {
+			return nil
+		}
+		got = ending.Label()
+	}
+	return errors.New("- " + label + "\n+ " + got)
+}
+
+func expect(u *state.Universe, s *state.State, condition string) error {
+	e, err := parser.ParseCondition(u, condition)
+	if err != nil {
+		return err
+	}
+	if e.Evaluate(s) {
+		return nil
+	}
+	// Show the values of everything the condition looked at
+	diff := []string{"- " + condition}
+	for _, f := range factorsIn(e, nil) {
+		diff = append(diff, "+ "+f.Label()+" = "+string(s.Get(f)))
+	}
+	return errors.New(strings.Join(diff, "\n"))
+}
+
+// The factors e refers to, added to fs in the order they come up.
+func factorsIn(e state.BoolExpr, fs []*state.Factor) []*state.Factor {
+	add := func(f *state.Factor) []*state.Factor {
+		for _, g := range fs {
+			if g == f {
+				return fs
+			}
+		}
+		return append(fs, f)
+	}
+	switch e := e.(type) {
+	case state.FactorEquals:
+		return add(e.Factor)
+	case state.Compare:
+		return add(e.Factor)
+	case state.Not:
+		return factorsIn(e.Clause, fs)
+	case state.And:
+		for _, c := range e.Clauses {
+			fs = factorsIn(c, fs)
+		}
+	case state.Or:
+		for _, c := range e.Clauses {
+			fs = factorsIn(c, fs)
+		}
+	}
+	return fs
+}
@@ -0,0 +1,96 @@
+package storytest_test
+
+import (
+	"parser"
+	"storytest"
+	"strings"
+	"testing"
+)
+
+func assert(t *testing.T, name string, want interface{}, got interface{}) bool {
+	r := want == got
+	if !r {
+		t.Error(name, " expected:", want, " got:", got)
+	}
+	return r
+}
+
+const story = `
+factor loc : (Hall, Room)
+factor coins : (0:3)
+transition enter : (loc = Hall, choice : "Enter.", loc -> Room, "You go in.")
+transition find : (loc = Room & coins < 3, spontaneous 1, coins + 1, "You find a coin.")
+ending rich : (coins = 3, "You are rich.")
+`
+
+func run(t *testing.T, test string) []storytest.Result {
+	u, err := parser.ParseString(story, "story")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := storytest.Parse(strings.NewReader(test), "story.plot.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.RunUniverse(u)
+}
+
+func Test_Parse(t *testing.T) {
+	st, err := storytest.Parse(strings.NewReader("% A test\nstory \"other.plot\"\nseed 7\nchoose \"Enter.\"\nwait\n"), "story.plot.test")
+	if !assert(t, "No errors", nil, err) {
+		return
+	}
+	assert(t, "Story", "other.plot", st.Story)
+	assert(t, "Seed", int64(7), st.Seed)
+	if assert(t, "Steps", 2, len(st.Steps)) {
+		assert(t, "Step line", 4, st.Steps[0].Line)
+		assert(t, "Step text", "wait", st.Steps[1].Text)
+	}
+
+	st, _ = storytest.Parse(strings.NewReader("wait\n"), "dir/story.plot.test")
+	assert(t, "Default story", "story.plot", st.Story)
+
+	_, err = storytest.Parse(strings.NewReader("wait\nseed 3\n"), "story.plot.test")
+	if assert(t, "Late seed", true, err != nil) {
+		assert(t, "Late seed error", "story.plot.test:2: seed has to come before the first step", err.Error())
+	}
+	_, err = storytest.Parse(strings.NewReader("jump\n"), "story.plot.test")
+	assert(t, "Unknown step", true, err != nil)
+}
+
+func Test_Pass(t *testing.T) {
+	results := run(t, `
+expect loc = Hall & coins = 0
+choose "Enter."
+expect text "You go in."
+expect text "You find a coin."
+wait
+wait
+expect coins = 3
+expect ending rich
+`)
+	assert(t, "Results", 8, len(results))
+	for _, res := range results {
+		assert(t, "Passed "+res.Step.Text, true, res.Passed)
+	}
+}
+
+func Test_Fail(t *testing.T) {
+	results := run(t, `
+expect loc = Room
+expect text "You go in."
+choose enter
+expect ending rich
+choose "Leave."
+expect coins = 1
+`)
+	if !assert(t, "Results", 6, len(results)) {
+		return
+	}
+	assert(t, "Condition", "- loc = Room\n+ loc = Hall", results[0].Diff)
+	assert(t, "Text", "- You go in.", results[1].Diff)
+	assert(t, "Choice by label", true, results[2].Passed)
+	assert(t, "Ending", "- rich\n+ (no ending)", results[3].Diff)
+	assert(t, "Choice", "- Leave.", results[4].Diff)
+	assert(t, "After bad choice", false, results[5].Passed)
+}